@@ -0,0 +1,432 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/spf13/cobra"
+)
+
+// The columns of the input CSV which identify the recipient, in the order they are used
+const (
+	bulkColumnID    = "id"
+	bulkColumnPhone = "phone"
+	bulkColumnEmail = "email"
+)
+
+var (
+	bulkTemplateFile string
+	bulkMessage      string
+	bulkResultFile   string
+	bulkConcurrency  int
+	bulkRate         float64
+	bulkDryRun       bool
+)
+
+func init() {
+	bulkCmd.Flags().StringVar(&bulkTemplateFile, "template", "", "File with the text/template of the message")
+	bulkCmd.Flags().StringVar(&bulkMessage, "message", "", "The text/template of the message")
+	bulkCmd.Flags().StringVar(&bulkResultFile, "result", "", "Write the result CSV to this file instead of stdout")
+	bulkCmd.Flags().IntVar(&bulkConcurrency, "concurrency", 4, "Number of messages sent at the same time")
+	bulkCmd.Flags().Float64Var(&bulkRate, "rate", 10, "Maximum number of messages per second (0 for no limit)")
+	bulkCmd.Flags().BoolVar(&bulkDryRun, "dry-run", false, "Only render the messages, don't resolve recipients or send anything")
+	rootCmd.AddCommand(bulkCmd)
+}
+
+var bulkCmd = &cobra.Command{
+	Use:   "bulk <csv-file>",
+	Short: "Send a personalized message to every recipient of a CSV file",
+	Long: `Send a personalized message to every row of a CSV file.
+
+The first row of the CSV file contains the column names. The recipient is taken from the
+column "id", "phone" or "email", the first one that is not empty. Phone numbers and email addresses
+are resolved with hashed lookups. The message is a Go text/template, which can use all columns,
+for example: Hello {{.name}}, your next shift starts {{.start}}.
+
+The result CSV contains the row number, the recipient, the Threema ID and the message ID or the error.
+Every row is written as soon as its message was sent, in the order the messages were sent.
+With --output json, the result is written as JSON array instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if math.IsNaN(bulkRate) || bulkRate < 0 {
+			fail(usageErrorf("--rate must not be negative"))
+		}
+		messageTemplate, err := loadBulkTemplate()
+		if err != nil {
+			fail(err)
+		}
+		rows, err := readBulkRows(args[0])
+		if err != nil {
+			fail(err)
+		}
+
+		sender := &bulkSender{
+			template: messageTemplate,
+			dryRun:   bulkDryRun,
+		}
+		if !bulkDryRun {
+			if sender.client, err = newEncryptedClient(); err != nil {
+				fail(err)
+			}
+		}
+
+		output := os.Stdout
+		if bulkResultFile != "" {
+			if output, err = os.Create(bulkResultFile); err != nil {
+				fail(err)
+			}
+		}
+		writer, err := newBulkResultWriter(output, bulkDryRun)
+		if err == nil {
+			var results []*bulkResult
+			results, err = sender.sendAll(rows, bulkConcurrency, bulkRate, writer.write)
+			if closeErr := writer.close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = bulkError(results)
+			}
+		}
+		if bulkResultFile != "" {
+			if closeErr := output.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fail(err)
+		}
+	},
+}
+
+func loadBulkTemplate() (*template.Template, error) {
+	text := bulkMessage
+	switch {
+	case bulkTemplateFile != "" && bulkMessage != "":
+		return nil, usageErrorf("--template and --message can't be used together")
+	case bulkTemplateFile != "":
+		content, err := ioutil.ReadFile(bulkTemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	case bulkMessage == "":
+		return nil, usageErrorf("either --template or --message is required")
+	}
+	return template.New("message").Option("missingkey=error").Parse(text)
+}
+
+// A row of the input CSV
+type bulkRow struct {
+	// The number of the row in the CSV file, without the header
+	number  int
+	columns map[string]string
+}
+
+// Returns the recipient of the row as written in the CSV file and the column it was taken from
+func (r *bulkRow) recipient() (value string, column string) {
+	for _, column = range []string{bulkColumnID, bulkColumnPhone, bulkColumnEmail} {
+		if value = strings.TrimSpace(r.columns[column]); value != "" {
+			return
+		}
+	}
+	return "", ""
+}
+
+func readBulkRows(path string) ([]*bulkRow, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("can't read header of %s: %s", path, err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	var rows []*bulkRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := &bulkRow{
+			number:  len(rows) + 1,
+			columns: make(map[string]string, len(header)),
+		}
+		for i, name := range header {
+			row.columns[name] = record[i]
+			// The recipient columns are case insensitive
+			if lower := strings.ToLower(name); lower == bulkColumnID || lower == bulkColumnPhone || lower == bulkColumnEmail {
+				row.columns[lower] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+type bulkResult struct {
+	row       *bulkRow
+	recipient string
+	id        string
+	message   string
+	messageID string
+	err       error
+}
+
+type bulkSender struct {
+	client   *gateway.EncryptedClient
+	template *template.Template
+	dryRun   bool
+}
+
+// Render, resolve and send the messages of all rows. Every result is passed to report as soon as
+// the message was sent. If report fails, no further messages are sent and the error is returned.
+// The returned results are in the order of the rows, rows that were not sent are omitted.
+func (s *bulkSender) sendAll(rows []*bulkRow, concurrency int, rate float64, report func(*bulkResult) error) ([]*bulkResult, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var limit <-chan time.Time
+	if rate > 0 && !s.dryRun {
+		interval := time.Duration(float64(time.Second) / rate)
+		if interval < 1 {
+			interval = 1
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	results := make([]*bulkResult, len(rows))
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var (
+		workers   sync.WaitGroup
+		mutex     sync.Mutex
+		reportErr error
+	)
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for index := range indexes {
+				result := s.send(rows[index], limit)
+				mutex.Lock()
+				results[index] = result
+				if reportErr == nil {
+					if reportErr = report(result); reportErr != nil {
+						close(stop)
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for index := range rows {
+		select {
+		case indexes <- index:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(indexes)
+	workers.Wait()
+
+	sent := results[:0]
+	for _, result := range results {
+		if result != nil {
+			sent = append(sent, result)
+		}
+	}
+	return sent, reportErr
+}
+
+func (s *bulkSender) send(row *bulkRow, limit <-chan time.Time) *bulkResult {
+	result := &bulkResult{row: row}
+	var column string
+	result.recipient, column = row.recipient()
+	if result.recipient == "" {
+		result.err = errors.New("no recipient")
+		return result
+	}
+
+	var message bytes.Buffer
+	if result.err = s.template.Execute(&message, row.columns); result.err != nil {
+		return result
+	}
+	result.message = message.String()
+	if strings.TrimSpace(result.message) == "" {
+		result.err = errors.New("empty message")
+		return result
+	}
+	if s.dryRun {
+		if column == bulkColumnID {
+			result.id = strings.ToUpper(result.recipient)
+		}
+		return result
+	}
+
+	if limit != nil {
+		<-limit
+	}
+	if result.id, result.err = s.resolve(result.recipient, column); result.err != nil {
+		return result
+	}
+	result.messageID, result.err = s.client.SendTextMessage(result.id, result.message)
+	return result
+}
+
+func (s *bulkSender) resolve(recipient string, column string) (string, error) {
+	switch column {
+	case bulkColumnPhone:
+		return s.client.Client.LookupIDByPhoneHash(gateway.HashPhoneNumber(recipient))
+	case bulkColumnEmail:
+		return s.client.Client.LookupIDByEmailHash(gateway.HashEmail(recipient))
+	default:
+		return strings.ToUpper(recipient), nil
+	}
+}
+
+// Returns an error if any message failed. If all failures have the same exit code,
+// the error wraps the first failure, so the command exits with its code.
+func bulkError(results []*bulkResult) error {
+	var (
+		failed int
+		first  error
+		mixed  bool
+	)
+	for _, result := range results {
+		if result.err == nil {
+			continue
+		}
+		failed++
+		if first == nil {
+			first = result.err
+		} else if exitCode(result.err) != exitCode(first) {
+			mixed = true
+		}
+	}
+	switch {
+	case failed == 0:
+		return nil
+	case mixed:
+		return fmt.Errorf("%d of %d messages failed", failed, len(results))
+	default:
+		return fmt.Errorf("%d of %d messages failed: %w", failed, len(results), first)
+	}
+}
+
+type jsonBulkResult struct {
+	Row       int    `json:"row"`
+	Recipient string `json:"recipient"`
+	ID        string `json:"id,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// The bulkResultWriter writes the results as CSV or, with --output json, as JSON array.
+// Every result is written to the output immediately, so the result survives an interrupted run.
+type bulkResultWriter struct {
+	output io.Writer
+	// The rendered messages are only included if withMessage is set
+	withMessage bool
+	csv         *csv.Writer
+	// The number of results written
+	count int
+}
+
+// Create the writer and write the header or the start of the JSON array
+func newBulkResultWriter(output io.Writer, withMessage bool) (*bulkResultWriter, error) {
+	w := &bulkResultWriter{
+		output:      output,
+		withMessage: withMessage,
+	}
+	if jsonOutput() {
+		_, err := io.WriteString(output, "[")
+		return w, err
+	}
+	w.csv = csv.NewWriter(output)
+	header := []string{"row", "recipient", "id", "messageId", "error"}
+	if withMessage {
+		header = append(header, "message")
+	}
+	if err := w.csv.Write(header); err != nil {
+		return nil, err
+	}
+	w.csv.Flush()
+	return w, w.csv.Error()
+}
+
+func (w *bulkResultWriter) write(result *bulkResult) error {
+	var errorText string
+	if result.err != nil {
+		errorText = result.err.Error()
+	}
+	w.count++
+	if w.csv == nil {
+		value := &jsonBulkResult{
+			Row:       result.row.number,
+			Recipient: result.recipient,
+			ID:        result.id,
+			MessageID: result.messageID,
+			Error:     errorText,
+		}
+		if w.withMessage {
+			value.Message = result.message
+		}
+		encoded, err := json.MarshalIndent(value, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		separator := ",\n  "
+		if w.count == 1 {
+			separator = "\n  "
+		}
+		_, err = fmt.Fprintf(w.output, "%s%s", separator, encoded)
+		return err
+	}
+
+	record := []string{strconv.Itoa(result.row.number), result.recipient, result.id, result.messageID, errorText}
+	if w.withMessage {
+		record = append(record, result.message)
+	}
+	if err := w.csv.Write(record); err != nil {
+		return err
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// Write the end of the JSON array
+func (w *bulkResultWriter) close() error {
+	if w.csv != nil {
+		return nil
+	}
+	end := "\n]\n"
+	if w.count == 0 {
+		end = "]\n"
+	}
+	_, err := io.WriteString(w.output, end)
+	return err
+}
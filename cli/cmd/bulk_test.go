@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/gatewaytest"
+)
+
+func writeTempCSV(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rows.csv")
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadBulkRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		columns []map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "case insensitive recipient columns",
+			content: "ID, Phone ,EMAIL,name\nECHOECHO,,,Ann\n,41791234567,,Bob\n,,a@example.com,Cy\n",
+			columns: []map[string]string{
+				{"ID": "ECHOECHO", "id": "ECHOECHO", "Phone": "", "phone": "", "EMAIL": "", "email": "", "name": "Ann"},
+				{"ID": "", "id": "", "Phone": "41791234567", "phone": "41791234567", "EMAIL": "", "email": "", "name": "Bob"},
+				{"ID": "", "id": "", "Phone": "", "phone": "", "EMAIL": "a@example.com", "email": "a@example.com", "name": "Cy"},
+			},
+		},
+		{
+			name:    "header only",
+			content: "id,name\n",
+		},
+		{
+			name:    "ragged row",
+			content: "id,name\nECHOECHO,Ann\nABCDEFGH\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty file",
+			content: "",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, err := readBulkRows(writeTempCSV(t, test.content))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(rows) != len(test.columns) {
+				t.Fatalf("got %d rows, expected %d", len(rows), len(test.columns))
+			}
+			for i, row := range rows {
+				if row.number != i+1 {
+					t.Errorf("row %d has number %d", i, row.number)
+				}
+				if !reflect.DeepEqual(row.columns, test.columns[i]) {
+					t.Errorf("row %d: got %v, expected %v", i, row.columns, test.columns[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBulkRowRecipient(t *testing.T) {
+	tests := []struct {
+		columns map[string]string
+		value   string
+		column  string
+	}{
+		{map[string]string{"id": "ECHOECHO", "phone": "41791234567", "email": "a@example.com"}, "ECHOECHO", bulkColumnID},
+		{map[string]string{"id": " ", "phone": "41791234567", "email": "a@example.com"}, "41791234567", bulkColumnPhone},
+		{map[string]string{"phone": "", "email": " a@example.com "}, "a@example.com", bulkColumnEmail},
+		{map[string]string{"name": "Ann"}, "", ""},
+	}
+	for _, test := range tests {
+		row := &bulkRow{columns: test.columns}
+		if value, column := row.recipient(); value != test.value || column != test.column {
+			t.Errorf("%v: got %q from %q, expected %q from %q", test.columns, value, column, test.value, test.column)
+		}
+	}
+}
+
+func TestLoadBulkTemplate(t *testing.T) {
+	defer func(message string) { bulkMessage = message }(bulkMessage)
+	bulkMessage = "Hello {{.name}}"
+	messageTemplate, err := loadBulkTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rendered bytes.Buffer
+	if err = messageTemplate.Execute(&rendered, map[string]string{"name": "Ann"}); err != nil || rendered.String() != "Hello Ann" {
+		t.Errorf("rendered %q, %v", rendered.String(), err)
+	}
+	if err = messageTemplate.Execute(&rendered, map[string]string{"id": "ECHOECHO"}); err == nil {
+		t.Error("missing column was rendered")
+	}
+
+	bulkMessage = ""
+	if _, err = loadBulkTemplate(); exitCode(err) != exitUsage {
+		t.Errorf("expected usage error without template, got %v", err)
+	}
+}
+
+func TestBulkError(t *testing.T) {
+	results := func(errs ...error) []*bulkResult {
+		values := make([]*bulkResult, len(errs))
+		for i, err := range errs {
+			values[i] = &bulkResult{err: err}
+		}
+		return values
+	}
+	tests := []struct {
+		name    string
+		results []*bulkResult
+		code    int
+	}{
+		{"success", results(nil, nil), 0},
+		{"uniform", results(nil, gateway.ErrMissingCredits, gateway.ErrMissingCredits), exitMissingCredits},
+		{"mixed", results(gateway.ErrMissingCredits, gateway.ErrIDNotFound), exitError},
+		{"data error", results(gateway.ErrWrongIdentityLength), exitError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := bulkError(test.results)
+			if test.code == 0 {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || exitCode(err) != test.code {
+				t.Errorf("got %v with exit code %d, expected %d", err, exitCode(err), test.code)
+			}
+		})
+	}
+}
+
+func TestBulkResultWriter(t *testing.T) {
+	defer func(format string) { outputFormat = format }(outputFormat)
+	row := func(number int) *bulkRow { return &bulkRow{number: number} }
+	sent := &bulkResult{row: row(1), recipient: "ECHOECHO", id: "ECHOECHO", messageID: "0102030405060708", message: "Hi"}
+	failed := &bulkResult{row: row(2), recipient: "a@example.com", err: gateway.ErrIDNotFound}
+	tests := []struct {
+		name        string
+		format      string
+		withMessage bool
+		results     []*bulkResult
+		expected    string
+	}{
+		{"empty csv", outputText, false, nil, "row,recipient,id,messageId,error\n"},
+		{"csv", outputText, true, []*bulkResult{sent, failed},
+			"row,recipient,id,messageId,error,message\n1,ECHOECHO,ECHOECHO,0102030405060708,,Hi\n2,a@example.com,,,threema identity not found,\n"},
+		{"empty json", outputJSON, false, nil, "[]\n"},
+		{"json", outputJSON, false, []*bulkResult{sent, failed},
+			"[\n  {\n    \"row\": 1,\n    \"recipient\": \"ECHOECHO\",\n    \"id\": \"ECHOECHO\",\n    \"messageId\": \"0102030405060708\"\n  },\n" +
+				"  {\n    \"row\": 2,\n    \"recipient\": \"a@example.com\",\n    \"error\": \"threema identity not found\"\n  }\n]\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputFormat = test.format
+			var output bytes.Buffer
+			writer, err := newBulkResultWriter(&output, test.withMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, result := range test.results {
+				if err = writer.write(result); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = writer.close(); err != nil {
+				t.Fatal(err)
+			}
+			if output.String() != test.expected {
+				t.Errorf("got\n%s\nexpected\n%s", output.String(), test.expected)
+			}
+		})
+	}
+}
+
+func newTestBulkSender(t *testing.T, text string) (*bulkSender, *gatewaytest.Server) {
+	t.Helper()
+	server := gatewaytest.NewServer()
+	t.Cleanup(server.Close)
+	account, err := server.NewAccount("*TESTTST", "secret", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(message string) { bulkMessage = message }(bulkMessage)
+	bulkMessage = text
+	messageTemplate, err := loadBulkTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &bulkSender{client: server.NewEncryptedClient(account), template: messageTemplate}, server
+}
+
+func TestSendAll(t *testing.T) {
+	sender, server := newTestBulkSender(t, "Hello {{.name}}")
+	var rows []*bulkRow
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("USER000%d", i)
+		if _, err := server.NewIdentity(id); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, &bulkRow{number: i, columns: map[string]string{"id": id, "name": fmt.Sprint("user ", i)}})
+	}
+	rows = append(rows, &bulkRow{number: 6, columns: map[string]string{"name": "nobody"}})
+
+	var reported []int
+	results, err := sender.sendAll(rows, 3, 0, func(result *bulkResult) error {
+		reported = append(reported, result.row.number)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(rows) || len(reported) != len(rows) {
+		t.Fatalf("%d results, %d reported for %d rows", len(results), len(reported), len(rows))
+	}
+	for i, result := range results {
+		if result.row != rows[i] {
+			t.Errorf("result %d is of row %d", i, result.row.number)
+		}
+	}
+	if results[0].err != nil || results[0].messageID == "" || results[0].message != "Hello user 1" {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+	if results[5].err == nil {
+		t.Error("row without recipient was sent")
+	}
+	if sent := server.SentMessages(); len(sent) != 5 {
+		t.Errorf("%d messages sent", len(sent))
+	}
+}
+
+func TestSendAllStopsWhenReportFails(t *testing.T) {
+	sender, server := newTestBulkSender(t, "Hello")
+	if _, err := server.NewIdentity("ECHOECHO"); err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]*bulkRow, 10)
+	for i := range rows {
+		rows[i] = &bulkRow{number: i + 1, columns: map[string]string{"id": "ECHOECHO"}}
+	}
+	failure := errors.New("disk full")
+	results, err := sender.sendAll(rows, 1, 0, func(result *bulkResult) error {
+		return failure
+	})
+	if err != failure {
+		t.Errorf("expected the report error, got %v", err)
+	}
+	// The worker may already have received the next row when the report failed
+	if len(results) > 2 || len(server.SentMessages()) > 2 {
+		t.Errorf("%d rows sent after the report failed", len(results))
+	}
+	if !strings.HasPrefix(results[0].message, "Hello") {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/coffeemakr/threema/gateway"
+)
+
+const defaultProfileName = "default"
+
+// Environment variables overriding the configuration file
+const (
+	envConfig        = "THREEMA_CONFIG"
+	envProfile       = "THREEMA_PROFILE"
+	envID            = "THREEMA_ID"
+	envSecret        = "THREEMA_SECRET"
+	envKeyFile       = "THREEMA_KEY_FILE"
+	envKeyPassphrase = "THREEMA_KEY_PASSPHRASE"
+)
+
+var (
+	configPath  string
+	profileName string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Configuration file (default ~/.config/threema/config, or $"+envConfig+")")
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "Profile of the configuration file (default \"default\", or $"+envProfile+")")
+}
+
+// A profile holds the credentials of a gateway identity
+type profile struct {
+	ID      string
+	Secret  string
+	KeyFile string
+}
+
+// Parse the configuration file. The file consists of sections with the name of the profile:
+//
+//	[default]
+//	id = *ABCDEFG
+//	secret = apisecret
+//	key-file = ~/.config/threema/key
+//
+// Empty lines and lines starting with '#' or ';' are ignored.
+func parseConfig(file *os.File) (map[string]*profile, error) {
+	profiles := make(map[string]*profile)
+	var current *profile
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if profiles[name] == nil {
+				profiles[name] = new(profile)
+			}
+			current = profiles[name]
+			continue
+		}
+		separator := strings.IndexByte(line, '=')
+		if separator < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", file.Name(), lineNumber)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: value outside of a profile", file.Name(), lineNumber)
+		}
+		key := strings.TrimSpace(line[:separator])
+		value := strings.TrimSpace(line[separator+1:])
+		switch key {
+		case "id":
+			current.ID = value
+		case "secret":
+			current.Secret = value
+		case "key-file":
+			current.KeyFile = expandHome(value)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key %q", file.Name(), lineNumber, key)
+		}
+	}
+	return profiles, scanner.Err()
+}
+
+// Refuse a configuration file with an API secret that is accessible by group or others,
+// like ssh refuses such private keys. Windows has no such permission bits.
+func checkConfigPermissions(file *os.File, profiles map[string]*profile) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	hasSecret := false
+	for _, p := range profiles {
+		hasSecret = hasSecret || p.Secret != ""
+	}
+	if !hasSecret {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("permissions %04o for %s are too open, it contains a secret (run chmod 600 %s)", perm, file.Name(), file.Name())
+	}
+	return nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "threema", "config")
+}
+
+// Load the selected profile and apply the environment variables.
+// A missing configuration file is only an error if it or the profile was selected explicitly.
+func loadProfile() (*profile, error) {
+	path, explicitPath := configPath, true
+	if path == "" {
+		path = os.Getenv(envConfig)
+	}
+	if path == "" {
+		path, explicitPath = defaultConfigPath(), false
+	}
+	name, explicitName := profileName, true
+	if name == "" {
+		name = os.Getenv(envProfile)
+	}
+	if name == "" {
+		name, explicitName = defaultProfileName, false
+	}
+
+	selected := new(profile)
+	file, err := os.Open(path)
+	switch {
+	case err == nil:
+		profiles, err := parseConfig(file)
+		if err == nil {
+			err = checkConfigPermissions(file, profiles)
+		}
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if profiles[name] != nil {
+			selected = profiles[name]
+		} else if explicitName {
+			return nil, fmt.Errorf("profile %q not found in %s", name, path)
+		}
+	case os.IsNotExist(err) && !explicitPath && !explicitName:
+	default:
+		return nil, err
+	}
+
+	if value := os.Getenv(envID); value != "" {
+		selected.ID = value
+	}
+	if value := os.Getenv(envSecret); value != "" {
+		selected.Secret = value
+	}
+	if value := os.Getenv(envKeyFile); value != "" {
+		selected.KeyFile = value
+	}
+	return selected, nil
+}
+
+func (p *profile) requireID() error {
+	if p.ID == "" {
+		return errors.New("no gateway ID configured (set id in the profile or $" + envID + ")")
+	}
+	return nil
+}
+
+func (p *profile) requireSecret() error {
+	if p.Secret == "" {
+		return errors.New("no API secret configured (set secret in the profile or $" + envSecret + ")")
+	}
+	return nil
+}
+
+// Read the secret key from the key file. An encrypted key file is decrypted with the passphrase
+// in the environment variable.
+func (p *profile) secretKey() (*gateway.SecretKey, error) {
+	if p.KeyFile == "" {
+		return nil, errors.New("no key file configured (set key-file in the profile or $" + envKeyFile + ")")
+	}
+	secretKey, err := gateway.ReadKeyFile(p.KeyFile, keyPassphrase())
+	if err == gateway.ErrPassphraseRequired {
+		return nil, fmt.Errorf("%s is encrypted, set the passphrase in $%s", p.KeyFile, envKeyPassphrase)
+	}
+	return secretKey, err
+}
+
+func keyPassphrase() []byte {
+	if passphrase, ok := os.LookupEnv(envKeyPassphrase); ok {
+		return []byte(passphrase)
+	}
+	return nil
+}
+
+// Create a client for the simple API of the configured identity
+func newClient() (*gateway.Client, error) {
+	p, err := loadProfile()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.requireID(); err != nil {
+		return nil, err
+	}
+	if err = p.requireSecret(); err != nil {
+		return nil, err
+	}
+	return &gateway.Client{
+		ID:     p.ID,
+		Secret: p.Secret,
+	}, nil
+}
+
+// Create an end-to-end encrypted client for the configured identity
+func newEncryptedClient() (*gateway.EncryptedClient, error) {
+	p, err := loadProfile()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.requireID(); err != nil {
+		return nil, err
+	}
+	if err = p.requireSecret(); err != nil {
+		return nil, err
+	}
+	secretKey, err := p.secretKey()
+	if err != nil {
+		return nil, err
+	}
+	return gateway.NewKeyProviderEncryptedClient(p.ID, p.Secret, gateway.NewSecretKeyProvider(secretKey))
+}
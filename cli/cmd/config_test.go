@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func writeTempConfig(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config")
+	if err = ioutil.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		profiles map[string]*profile
+		wantErr  bool
+	}{
+		{
+			name: "sections and comments",
+			content: "# comment\n; other comment\n\n[default]\nid = *ABCDEFG\n  secret=apisecret  \n" +
+				"[ other ]\nid = *HIJKLMN\nkey-file = /etc/threema/key\n[default]\nkey-file = key\n",
+			profiles: map[string]*profile{
+				"default": {ID: "*ABCDEFG", Secret: "apisecret", KeyFile: "key"},
+				"other":   {ID: "*HIJKLMN", KeyFile: "/etc/threema/key"},
+			},
+		},
+		{
+			name:     "value containing separator",
+			content:  "[default]\nsecret = a=b\n",
+			profiles: map[string]*profile{"default": {Secret: "a=b"}},
+		},
+		{
+			name:     "empty",
+			content:  "",
+			profiles: map[string]*profile{},
+		},
+		{name: "missing separator", content: "[default]\nid *ABCDEFG\n", wantErr: true},
+		{name: "value outside of a profile", content: "id = *ABCDEFG\n", wantErr: true},
+		{name: "unknown key", content: "[default]\nuser = *ABCDEFG\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := os.Open(writeTempConfig(t, test.content, 0600))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			profiles, err := parseConfig(file)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(profiles, test.profiles) {
+				t.Errorf("got %v, expected %v", profiles, test.profiles)
+			}
+		})
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	defer func(path, name string) { configPath, profileName = path, name }(configPath, profileName)
+	flagConfig := writeTempConfig(t, "[default]\nid = *FLAGDEF\nsecret = flag\n[other]\nid = *FLAGOTH\n", 0600)
+	envConfigPath := writeTempConfig(t, "[default]\nid = *ENVDEFA\n[other]\nid = *ENVOTHE\nkey-file = /key\n", 0600)
+	missing := filepath.Join(filepath.Dir(envConfigPath), "missing")
+
+	tests := []struct {
+		name     string
+		flags    [2]string
+		env      map[string]string
+		expected *profile
+		wantErr  bool
+	}{
+		{
+			name:     "config flag before environment",
+			flags:    [2]string{flagConfig, ""},
+			env:      map[string]string{envConfig: envConfigPath},
+			expected: &profile{ID: "*FLAGDEF", Secret: "flag"},
+		},
+		{
+			name:     "config environment",
+			env:      map[string]string{envConfig: envConfigPath},
+			expected: &profile{ID: "*ENVDEFA"},
+		},
+		{
+			name:     "profile flag before environment",
+			flags:    [2]string{flagConfig, "other"},
+			env:      map[string]string{envProfile: "default"},
+			expected: &profile{ID: "*FLAGOTH"},
+		},
+		{
+			name:     "profile environment",
+			env:      map[string]string{envConfig: envConfigPath, envProfile: "other"},
+			expected: &profile{ID: "*ENVOTHE", KeyFile: "/key"},
+		},
+		{
+			name:     "environment values before config file",
+			flags:    [2]string{flagConfig, ""},
+			env:      map[string]string{envID: "*ENVIDEN", envSecret: "env", envKeyFile: "/env.key"},
+			expected: &profile{ID: "*ENVIDEN", Secret: "env", KeyFile: "/env.key"},
+		},
+		{
+			name:    "unknown profile",
+			flags:   [2]string{flagConfig, "unknown"},
+			wantErr: true,
+		},
+		{
+			name:    "missing explicit config",
+			flags:   [2]string{missing, ""},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{envConfig, envProfile, envID, envSecret, envKeyFile} {
+				setenv(t, key, test.env[key])
+			}
+			configPath, profileName = test.flags[0], test.flags[1]
+			p, err := loadProfile()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(p, test.expected) {
+				t.Errorf("got %+v, expected %+v", p, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadProfilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on windows")
+	}
+	defer func(path, name string) { configPath, profileName = path, name }(configPath, profileName)
+	profileName = ""
+	for _, key := range []string{envConfig, envProfile, envID, envSecret, envKeyFile} {
+		setenv(t, key, "")
+	}
+	tests := []struct {
+		content string
+		perm    os.FileMode
+		wantErr bool
+	}{
+		{"[default]\nsecret = apisecret\n", 0600, false},
+		{"[default]\nsecret = apisecret\n", 0640, true},
+		{"[other]\nsecret = apisecret\n", 0604, true},
+		{"[default]\nid = *ABCDEFG\n", 0644, false},
+	}
+	for _, test := range tests {
+		configPath = writeTempConfig(t, test.content, test.perm)
+		if _, err := loadProfile(); (err != nil) != test.wantErr {
+			t.Errorf("%q with %04o: error = %v, wantErr %v", test.content, test.perm, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"github.com/spf13/cobra"
+)
+
+var (
+	decryptCallbackFile string
+	decryptSender       string
+	decryptNonce        string
+	decryptBox          string
+	decryptPublicKey    string
+)
+
+func init() {
+	decryptCmd.Flags().StringVar(&decryptCallbackFile, "callback", "", "File with a captured form encoded callback body (- for stdin)")
+	decryptCmd.Flags().StringVar(&decryptSender, "sender", "", "Threema ID of the sender")
+	decryptCmd.Flags().StringVar(&decryptNonce, "nonce", "", "Hex encoded nonce")
+	decryptCmd.Flags().StringVar(&decryptBox, "box", "", "Hex encoded box")
+	decryptCmd.Flags().StringVar(&decryptPublicKey, "public-key", "", "Hex encoded public key of the sender instead of looking it up")
+	addJSONFlag(decryptCmd)
+	rootCmd.AddCommand(decryptCmd)
+}
+
+// The decrypted content of a box
+type decryptResult struct {
+	// The callback, if the box was read from a callback body. Its MAC was verified.
+	Callback      *callback.EncryptedMessage `json:"callback,omitempty"`
+	Sender        string                     `json:"sender"`
+	Plaintext     string                     `json:"plaintext"`
+	TypeByte      byte                       `json:"typeByte"`
+	Type          gateway.MessageType        `json:"type"`
+	PaddingLength int                        `json:"paddingLength"`
+	Message       json.RawMessage            `json:"message,omitempty"`
+	Error         string                     `json:"error,omitempty"`
+}
+
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Decrypt and inspect a box or a captured callback",
+	Long: `Decrypt and inspect a message sent to the gateway identity.
+
+The box is either given with --sender, --nonce and --box or read from a captured callback body
+with --callback. The MAC of a callback is verified with the API secret before it is decrypted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := newEncryptedClient()
+		if err != nil {
+			fail(err)
+		}
+		result := new(decryptResult)
+		var (
+			nonce *gateway.Nonce
+			box   []byte
+		)
+		if decryptCallbackFile != "" {
+			if decryptSender != "" || decryptNonce != "" || decryptBox != "" {
+				fail(usageErrorf("--callback can't be used with --sender, --nonce or --box"))
+			}
+			if result.Callback, err = readCallbackFile(decryptCallbackFile, client.Client.Secret); err != nil {
+				fail(err)
+			}
+			result.Sender, nonce, box = result.Callback.From, result.Callback.Nonce, result.Callback.Box
+		} else {
+			if decryptSender == "" || decryptNonce == "" || decryptBox == "" {
+				fail(usageErrorf("either --callback or --sender, --nonce and --box are required"))
+			}
+			if err := checkIDArg("--sender", decryptSender); err != nil {
+				fail(err)
+			}
+			result.Sender = decryptSender
+			if nonce, err = gateway.ReadHexNonce(decryptNonce); err != nil {
+				fail(err)
+			}
+			if box, err = hex.DecodeString(decryptBox); err != nil {
+				fail(err)
+			}
+		}
+
+		var publicKey *gateway.PublicKey
+		if decryptPublicKey != "" {
+			publicKey, err = gateway.ReadHexPublicKey(decryptPublicKey)
+		} else {
+			publicKey, err = client.LookupPublicKey(result.Sender)
+		}
+		if err != nil {
+			fail(err)
+		}
+		plaintext, err := client.EncryptionHelper.DecryptBytes(box, publicKey, nonce)
+		if err != nil {
+			fail(fmt.Errorf("decryption failed: %w", err))
+		}
+		result.inspect(plaintext)
+
+		if jsonOutput() {
+			printResult("", result)
+		} else {
+			result.print()
+		}
+		if result.Error != "" {
+			fail(errors.New(result.Error))
+		}
+	},
+}
+
+// Read the callback body from the file and verify its MAC
+func readCallbackFile(path string, secret string) (*callback.EncryptedMessage, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if path == "-" {
+		body, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		body, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	message, err := callback.ParseValues(values, secret)
+	if err == callback.ErrInvalidMAC {
+		return nil, errors.New("the MAC of the callback is invalid (wrong API secret or modified body)")
+	}
+	return message, err
+}
+
+// Decode the plaintext of the box. Errors are stored in the result, so the raw values can still be shown.
+func (r *decryptResult) inspect(plaintext []byte) {
+	r.Plaintext = hex.EncodeToString(plaintext)
+	if len(plaintext) == 0 {
+		r.Error = "empty plaintext"
+		return
+	}
+	r.TypeByte = plaintext[0]
+	r.Type = gateway.MessageType(plaintext[0])
+	r.PaddingLength = int(plaintext[len(plaintext)-1])
+	message, err := gateway.ReadMessage(plaintext)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	if r.Message, err = gateway.MarshalMessage(message); err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *decryptResult) print() {
+	if r.Callback != nil {
+		fmt.Printf("From:       %s\n", r.Callback.From)
+		if r.Callback.Nickname != "" {
+			fmt.Printf("Nickname:   %s\n", r.Callback.Nickname)
+		}
+		fmt.Printf("To:         %s\n", r.Callback.To)
+		fmt.Printf("Message ID: %x\n", r.Callback.MessageID[:])
+		fmt.Printf("Date:       %s\n", r.Callback.Date)
+		fmt.Printf("MAC:        valid\n")
+	} else {
+		fmt.Printf("From:       %s\n", r.Sender)
+	}
+	fmt.Printf("Type:       %s (0x%02x)\n", r.Type, r.TypeByte)
+	fmt.Printf("Padding:    %d bytes\n", r.PaddingLength)
+	fmt.Printf("Plaintext:  %s\n", r.Plaintext)
+	if r.Message != nil {
+		var indented strings.Builder
+		encoder := json.NewEncoder(&indented)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(json.RawMessage(r.Message)); err == nil {
+			fmt.Printf("Message:\n%s", indented.String())
+		}
+	}
+}
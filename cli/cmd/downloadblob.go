@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/spf13/cobra"
+)
+
+var (
+	downloadKey       string
+	downloadThumbnail bool
+	downloadNonce     string
+	downloadSender    string
+	downloadOutput    string
+)
+
+func init() {
+	downloadBlobCmd.Flags().StringVar(&downloadKey, "key", "", "Hex encoded key of a file or voice message")
+	downloadBlobCmd.Flags().BoolVar(&downloadThumbnail, "thumbnail", false, "The blob is the thumbnail of a file")
+	downloadBlobCmd.Flags().StringVar(&downloadNonce, "nonce", "", "Hex encoded nonce of an image message")
+	downloadBlobCmd.Flags().StringVar(&downloadSender, "sender", "", "Threema ID of the sender of an image message")
+	downloadBlobCmd.Flags().StringVarP(&downloadOutput, "output-file", "o", "", "Write the content to this file instead of stdout")
+	rootCmd.AddCommand(downloadBlobCmd)
+}
+
+var downloadBlobCmd = &cobra.Command{
+	Use:   "download-blob <blob-id>",
+	Short: "Download and decrypt a blob",
+	Long: `Download and decrypt the blob of a file, voice or image message.
+
+Files and voice messages are decrypted with --key, images with --nonce and the public key of
+the --sender. Without any of these flags, the encrypted blob is written.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		blobID, err := gateway.ReadBlobID(args[0])
+		if err != nil {
+			fail(err)
+		}
+		if downloadKey != "" && (downloadNonce != "" || downloadSender != "") {
+			fail(usageErrorf("--key can't be used with --nonce or --sender"))
+		}
+		if downloadThumbnail && downloadKey == "" {
+			fail(usageErrorf("--thumbnail requires --key"))
+		}
+		if (downloadNonce == "") != (downloadSender == "") {
+			fail(usageErrorf("--nonce and --sender must be used together"))
+		}
+		if downloadSender != "" {
+			if err := checkIDArg("--sender", downloadSender); err != nil {
+				fail(err)
+			}
+		}
+		if downloadOutput == "" && jsonOutput() {
+			fail(usageErrorf("--output json requires --output-file"))
+		}
+		client, err := newEncryptedClient()
+		if err != nil {
+			fail(err)
+		}
+
+		var content []byte
+		switch {
+		case downloadKey != "":
+			content, err = downloadSymmetric(client, blobID)
+		case downloadNonce != "":
+			content, err = downloadImage(client, blobID)
+		default:
+			content, err = client.Client.DownloadBlob(blobID)
+		}
+		if err != nil {
+			fail(err)
+		}
+
+		if downloadOutput == "" {
+			_, err = os.Stdout.Write(content)
+		} else {
+			err = ioutil.WriteFile(downloadOutput, content, 0600)
+		}
+		if err != nil {
+			fail(err)
+		}
+		if downloadOutput != "" && jsonOutput() {
+			printResult("", map[string]interface{}{"blobId": args[0], "file": downloadOutput, "size": len(content)})
+		}
+	},
+}
+
+func downloadSymmetric(client *gateway.EncryptedClient, blobID *gateway.BlobID) ([]byte, error) {
+	key, err := gateway.ReadSharedKey(downloadKey)
+	if err != nil {
+		return nil, err
+	}
+	if !downloadThumbnail {
+		return client.DownloadFile(blobID, key)
+	}
+	content, err := client.Client.DownloadBlob(blobID)
+	if err != nil {
+		return nil, err
+	}
+	return gateway.DecryptWithSharedSecret(content, gateway.ThumbnailNonce, key)
+}
+
+func downloadImage(client *gateway.EncryptedClient, blobID *gateway.BlobID) ([]byte, error) {
+	nonce, err := gateway.ReadHexNonce(downloadNonce)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := client.LookupPublicKey(downloadSender)
+	if err != nil {
+		return nil, err
+	}
+	return client.DownloadImage(blobID, nonce, publicKey)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(fingerprintCmd)
+}
+
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint [identity]",
+	Short: "Print the public key fingerprint of the own or another identity",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			p, err := loadProfile()
+			if err != nil {
+				fail(err)
+			}
+			if err = p.requireID(); err != nil {
+				fail(err)
+			}
+			secretKey, err := p.secretKey()
+			if err != nil {
+				fail(err)
+			}
+			printFingerprint(p.ID, gateway.PublicKeyFromSecretKey(secretKey))
+			return
+		}
+
+		identity := args[0]
+		if err := checkIDArg("identity", identity); err != nil {
+			fail(err)
+		}
+		client, err := newClient()
+		if err != nil {
+			fail(err)
+		}
+		publicKey, err := client.LookupPublicKey(identity)
+		if err != nil {
+			fail(err)
+		}
+		printFingerprint(identity, publicKey)
+	},
+}
+
+func printFingerprint(identity string, publicKey *gateway.PublicKey) {
+	fingerprint := gateway.Fingerprint(publicKey)
+	printResult(fmt.Sprintf("%s %s", identity, fingerprint), map[string]string{"id": identity, "fingerprint": fingerprint})
+}
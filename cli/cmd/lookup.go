@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/spf13/cobra"
+)
+
+var lookupHashed bool
+
+func init() {
+	lookupPhoneCmd.Flags().BoolVar(&lookupHashed, "hash", false, "Send only the hash of the phone number")
+	lookupEmailCmd.Flags().BoolVar(&lookupHashed, "hash", false, "Send only the hash of the email address")
+	for _, cmd := range []*cobra.Command{lookupPublicKeyCmd, lookupPhoneCmd, lookupEmailCmd, capabilitiesCmd, creditsCmd} {
+		addJSONFlag(cmd)
+	}
+	lookupCmd.AddCommand(lookupPublicKeyCmd, lookupPhoneCmd, lookupEmailCmd)
+	rootCmd.AddCommand(lookupCmd, capabilitiesCmd, creditsCmd)
+}
+
+var lookupCmd = &cobra.Command{
+	Use:   "lookup",
+	Short: "Lookup public keys and Threema IDs",
+}
+
+var lookupPublicKeyCmd = &cobra.Command{
+	Use:   "pubkey <identity>",
+	Short: "Print the public key and its fingerprint of the identity",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		identity := args[0]
+		if err := checkIDArg("identity", identity); err != nil {
+			fail(err)
+		}
+		client, err := newClient()
+		if err != nil {
+			fail(err)
+		}
+		publicKey, err := client.LookupPublicKey(identity)
+		if err != nil {
+			fail(err)
+		}
+		result := struct {
+			ID          string `json:"id"`
+			PublicKey   string `json:"publicKey"`
+			Fingerprint string `json:"fingerprint"`
+		}{identity, fmt.Sprintf("%x", publicKey[:]), gateway.Fingerprint(publicKey)}
+		printResult(fmt.Sprintf("%s\nFingerprint: %s", result.PublicKey, result.Fingerprint), result)
+	},
+}
+
+// Create a command which looks up the ID by a phone number or email address
+func lookupIDCommand(use string, short string, field string, lookup func(client *gateway.Client, value string) (string, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client, err := newClient()
+			if err != nil {
+				fail(err)
+			}
+			id, err := lookup(client, args[0])
+			if err != nil {
+				fail(err)
+			}
+			printResult(id, map[string]string{field: args[0], "id": id})
+		},
+	}
+}
+
+var lookupPhoneCmd = lookupIDCommand("phone <number>", "Print the Threema ID linked to the phone number", "phone",
+	func(client *gateway.Client, phoneNumber string) (string, error) {
+		if lookupHashed {
+			return client.LookupIDByPhoneHash(gateway.HashPhoneNumber(phoneNumber))
+		}
+		return client.LookupIDByPhone(phoneNumber)
+	})
+
+var lookupEmailCmd = lookupIDCommand("email <address>", "Print the Threema ID linked to the email address", "email",
+	func(client *gateway.Client, email string) (string, error) {
+		if lookupHashed {
+			return client.LookupIDByEmailHash(gateway.HashEmail(email))
+		}
+		return client.LookupIDByEmail(email)
+	})
+
+var capabilitiesCmd = &cobra.Command{
+	Use:   "capabilities <identity>",
+	Short: "Print the message types the identity can receive",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := newClient()
+		if err != nil {
+			fail(err)
+		}
+		if err := checkIDArg("identity", args[0]); err != nil {
+			fail(err)
+		}
+		capabilities, err := client.LookupCapabilities(args[0])
+		if err != nil {
+			fail(err)
+		}
+		printResult(strings.Join(capabilities, ", "), map[string]interface{}{
+			"id":           args[0],
+			"capabilities": capabilities,
+		})
+	},
+}
+
+var creditsCmd = &cobra.Command{
+	Use:   "credits",
+	Short: "Print the remaining credits of the account",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := newClient()
+		if err != nil {
+			fail(err)
+		}
+		credits, err := client.RemainingCredits()
+		if err != nil {
+			fail(err)
+		}
+		printResult(fmt.Sprint(credits), map[string]int{"credits": credits})
+	},
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var outputFormat string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputText, "Output format: text or json")
+}
+
+func jsonOutput() bool {
+	return outputFormat == outputJSON
+}
+
+// The jsonFlag is the deprecated --json flag of a command, which sets --output json
+type jsonFlag struct{}
+
+func (jsonFlag) String() string {
+	return "false"
+}
+
+func (jsonFlag) Set(value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err == nil && enabled {
+		outputFormat = outputJSON
+	}
+	return err
+}
+
+func (jsonFlag) Type() string {
+	return "bool"
+}
+
+// Add the deprecated --json flag to a command, which was replaced by --output json
+func addJSONFlag(cmd *cobra.Command) {
+	flag := cmd.Flags().VarPF(jsonFlag{}, "json", "", "Print the result as JSON")
+	flag.NoOptDefVal = "true"
+	_ = cmd.Flags().MarkDeprecated("json", "use --output json instead")
+}
+
+// The formatFlag is a deprecated flag of a command that sets the --output format
+type formatFlag struct{}
+
+func (formatFlag) String() string {
+	return outputText
+}
+
+func (formatFlag) Set(value string) error {
+	outputFormat = value
+	return nil
+}
+
+func (formatFlag) Type() string {
+	return "string"
+}
+
+// Check the value of the --output flag
+func checkOutputFormat() error {
+	if outputFormat != outputText && outputFormat != outputJSON {
+		return usageErrorf("unknown output format %q", outputFormat)
+	}
+	return nil
+}
+
+// Print the human readable text or, with --output json, the value encoded as JSON
+func printResult(text string, value interface{}) {
+	if !jsonOutput() {
+		fmt.Println(text)
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		fail(err)
+	}
+}
+
+// Print the ID of a sent message
+func printMessageID(to string, messageID string) {
+	printResult(messageID, map[string]string{"to": to, "messageId": messageID})
+}
+
+// Exit codes of threema-cli
+const (
+	exitError            = 1
+	exitUsage            = 2
+	exitBadSecret        = 3
+	exitInvalidRecipient = 4
+	exitNotFound         = 5
+	exitMissingCredits   = 6
+	exitTooBig           = 7
+	exitTemporary        = 8
+)
+
+const exitCodesHelp = `Exit codes:
+  0  success
+  1  other error
+  2  invalid arguments or flags
+  3  API secret or identity is incorrect
+  4  recipient is invalid
+  5  identity not found
+  6  missing credits
+  7  message or blob is too big
+  8  temporary server error, try again later`
+
+// A usageError is caused by invalid arguments or flags
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, a...)}
+}
+
+// Check a Threema ID given as argument or flag. Malformed IDs are usage errors,
+// while malformed IDs in input files or responses exit with the generic error code.
+func checkIDArg(name string, id string) error {
+	if len(id) != 8 {
+		return usageErrorf("%s %q is not a Threema ID of 8 characters", name, id)
+	}
+	return nil
+}
+
+// Returns the exit code for the error
+func exitCode(err error) int {
+	var usage *usageError
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, gateway.ErrBadSecret):
+		return exitBadSecret
+	case errors.Is(err, gateway.ErrInvalidRecipient):
+		return exitInvalidRecipient
+	case errors.Is(err, gateway.ErrIDNotFound), errors.Is(err, gateway.ErrBlobNotFound):
+		return exitNotFound
+	case errors.Is(err, gateway.ErrMissingCredits):
+		return exitMissingCredits
+	case errors.Is(err, gateway.ErrMessageTooLong), errors.Is(err, gateway.ErrBlobTooBig):
+		return exitTooBig
+	case errors.Is(err, gateway.ErrInternalServerError):
+		return exitTemporary
+	default:
+		return exitError
+	}
+}
+
+// Print the error and exit with the exit code of the error.
+// With --output json, the error is written as JSON object to stderr.
+func fail(err error) {
+	code := exitCode(err)
+	if jsonOutput() {
+		_ = json.NewEncoder(os.Stderr).Encode(struct {
+			Error    string `json:"error"`
+			ExitCode int    `json:"exitCode"`
+		}{err.Error(), code})
+	} else {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/coffeemakr/threema/gateway"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{usageErrorf("unknown flag"), exitUsage},
+		{fmt.Errorf("row 3: %w", usageErrorf("wrapped")), exitUsage},
+		{gateway.ErrBadSecret, exitBadSecret},
+		{gateway.ErrInvalidRecipient, exitInvalidRecipient},
+		{gateway.ErrIDNotFound, exitNotFound},
+		{gateway.ErrBlobNotFound, exitNotFound},
+		{gateway.ErrMissingCredits, exitMissingCredits},
+		{gateway.ErrMessageTooLong, exitTooBig},
+		{gateway.ErrBlobTooBig, exitTooBig},
+		{gateway.ErrInternalServerError, exitTemporary},
+		{fmt.Errorf("sending failed: %w", gateway.ErrInternalServerError), exitTemporary},
+		// Malformed IDs from input files or responses are data errors
+		{gateway.ErrWrongIdentityLength, exitError},
+		{gateway.ErrRequestFailed, exitError},
+		{gateway.ErrInvalidIdentityCode, exitError},
+		{gateway.ErrInvalidThreemaURI, exitError},
+		{gateway.ErrPublicKeyMismatch, exitError},
+		{gateway.ErrWrongPassphrase, exitError},
+		{gateway.ErrInvalidKeyFile, exitError},
+		{gateway.ErrPassphraseRequired, exitError},
+		{gateway.ErrKeyDestroyed, exitError},
+		{errors.New("other"), exitError},
+	}
+	for _, test := range tests {
+		if code := exitCode(test.err); code != test.code {
+			t.Errorf("exitCode(%q) = %d, expected %d", test.err, code, test.code)
+		}
+	}
+}
+
+func TestCheckIDArg(t *testing.T) {
+	if err := checkIDArg("identity", "ECHOECHO"); err != nil {
+		t.Error(err)
+	}
+	for _, id := range []string{"", "ECHO", "ECHOECHO1"} {
+		if err := checkIDArg("identity", id); exitCode(err) != exitUsage {
+			t.Errorf("%q: expected usage error, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/spf13/cobra"
+)
+
+var (
+	qrCodeLink bool
+)
+
+func init() {
+	qrCodeCmd.Flags().BoolVar(&qrCodeLink, "link", false, "Print a threema://add link instead of the identity code")
+	rootCmd.AddCommand(qrCodeCmd)
+}
+
+var qrCodeCmd = &cobra.Command{
+	Use:   "qrcode",
+	Short: "Print the QR code payload to verify the gateway identity",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := loadProfile()
+		if err != nil {
+			fail(err)
+		}
+		if err = p.requireID(); err != nil {
+			fail(err)
+		}
+
+		if qrCodeLink {
+			uri := gateway.AddContactURI(p.ID)
+			printResult(uri, map[string]string{"id": p.ID, "uri": uri})
+			return
+		}
+		secretKey, err := p.secretKey()
+		if err != nil {
+			fail(err)
+		}
+		code, err := gateway.NewIdentityCode(p.ID, secretKey)
+		if err != nil {
+			fail(err)
+		}
+		printResult(code.String(), map[string]string{"id": p.ID, "identityCode": code.String()})
+	},
+}
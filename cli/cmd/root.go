@@ -1,19 +1,26 @@
 package cmd
 
 import (
-	"fmt"
-	"os"
-
 	"github.com/spf13/cobra"
 )
 
 var rootCmd = &cobra.Command{
-	Use: "threema-cli",
+	Use:   "threema-cli",
+	Short: "Send and receive messages with the Threema Gateway",
+	Long:  "Send and receive messages with the Threema Gateway.\n\n" + exitCodesHelp,
+	// Errors are printed by fail with the exit code
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return checkOutputFormat()
+	},
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		if exitCode(err) == exitError {
+			// Errors of cobra are caused by invalid arguments or flags
+			err = &usageError{message: err.Error()}
+		}
+		fail(err)
 	}
 }
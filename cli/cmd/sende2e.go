@@ -2,8 +2,6 @@ package cmd
 
 import (
 	"bufio"
-	"fmt"
-	"github.com/coffeemakr/threema/gateway"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,21 +14,22 @@ func init() {
 }
 
 var e2eCmd = &cobra.Command{
-	Use:  "sende2e",
-	Args: cobra.ExactArgs(4),
+	Use:   "sende2e <to>",
+	Short: "Send the text read from stdin end-to-end encrypted",
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		log.SetOutput(os.Stderr)
 		to := args[0]
-		from := args[1]
-		secret := args[2]
-		privateKey := args[3]
+		if err := checkIDArg("recipient", to); err != nil {
+			fail(err)
+		}
 
 		reader := bufio.NewReader(os.Stdin)
 		message, err := ioutil.ReadAll(reader)
 		if err != nil {
 			fail(err)
 		}
-		client, err := gateway.NewEncryptedClient(from, secret, privateKey)
+		client, err := newEncryptedClient()
 		if err != nil {
 			fail(err)
 		}
@@ -38,6 +37,6 @@ var e2eCmd = &cobra.Command{
 		if err != nil {
 			fail(err)
 		}
-		fmt.Println(messageID)
+		printMessageID(to, messageID)
 	},
 }
@@ -1,9 +1,6 @@
 package cmd
 
 import (
-	"fmt"
-	"os"
-
 	"github.com/coffeemakr/threema/gateway"
 	"github.com/spf13/cobra"
 )
@@ -18,15 +15,17 @@ func init() {
 }
 
 var sendFile = &cobra.Command{
-	Use: "send_file",
+	Use:   "send_file <to> <file>",
+	Short: "Send a file end-to-end encrypted",
+	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		to := args[0]
-		from := args[1]
-		secret := args[2]
-		privateKey := args[3]
-		filePath := args[4]
+		filePath := args[1]
+		if err := checkIDArg("recipient", to); err != nil {
+			fail(err)
+		}
 
-		client, err := gateway.NewEncryptedClient(from, secret, privateKey)
+		client, err := newEncryptedClient()
 		if err != nil {
 			fail(err)
 		}
@@ -39,12 +38,7 @@ var sendFile = &cobra.Command{
 		if err != nil {
 			fail(err)
 		}
-		fmt.Println(messageID)
+		printMessageID(to, messageID)
 		return
 	},
 }
-
-func fail(err error) {
-	_, _ = fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-	os.Exit(1)
-}
@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"fmt"
-	"github.com/coffeemakr/threema/gateway"
 	"github.com/spf13/cobra"
 )
 
@@ -11,15 +9,17 @@ func init()  {
 }
 
 var sendImageCmd = &cobra.Command{
-	Use: "send_image",
+	Use:   "send_image <to> <image>",
+	Short: "Send an image end-to-end encrypted",
+	Args:  cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		to := args[0]
-		from := args[1]
-		secret := args[2]
-		privateKey := args[3]
-		imageFilePath := args[4]
+		imageFilePath := args[1]
+		if err := checkIDArg("recipient", to); err != nil {
+			fail(err)
+		}
 
-		client, err := gateway.NewEncryptedClient(from, secret, privateKey)
+		client, err := newEncryptedClient()
 		if err != nil {
 			fail(err)
 		}
@@ -27,7 +27,7 @@ var sendImageCmd = &cobra.Command{
 		if err != nil {
 			fail(err)
 		}
-		fmt.Println(messageID)
+		printMessageID(to, messageID)
 		return nil
 	},
 }
\ No newline at end of file
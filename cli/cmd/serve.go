@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveAddress string
+	servePath    string
+	serveTLSCert string
+	serveTLSKey  string
+	serveSaveDir string
+)
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddress, "listen", ":8080", "Address to listen on")
+	serveCmd.Flags().StringVar(&servePath, "path", "/callback/", "Path of the callback URL")
+	serveCmd.Flags().StringVar(&serveTLSCert, "tls-cert", "", "Certificate file to serve HTTPS")
+	serveCmd.Flags().StringVar(&serveTLSKey, "tls-key", "", "Private key file of the certificate")
+	serveCmd.Flags().StringVar(&serveSaveDir, "save-dir", "", "Download files, images and voice messages to this directory")
+	serveCmd.Flags().Var(formatFlag{}, "format", "Output format: text or json (one message per line)")
+	_ = serveCmd.Flags().MarkDeprecated("format", "use --output instead")
+	rootCmd.AddCommand(serveCmd)
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Receive, decrypt and print the messages sent to the callback URL",
+	Long: `Receive, decrypt and print the messages sent to the callback URL.
+
+With --output json, every message is printed as JSON object on its own line, containing the
+"message" and the path of the saved "attachment".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if (serveTLSCert == "") != (serveTLSKey == "") {
+			fail(usageErrorf("--tls-cert and --tls-key must be used together"))
+		}
+		client, err := newEncryptedClient()
+		if err != nil {
+			fail(err)
+		}
+		if serveSaveDir != "" {
+			if err = os.MkdirAll(serveSaveDir, 0700); err != nil {
+				fail(err)
+			}
+		}
+
+		receiver := &messagePrinter{
+			client:  client,
+			output:  os.Stdout,
+			json:    jsonOutput(),
+			saveDir: serveSaveDir,
+		}
+		handler := callback.NewHandler(client)
+		handler.HandleDefault(receiver.handle)
+
+		mux := http.NewServeMux()
+		mux.Handle(servePath, handler)
+		server := &http.Server{
+			Addr:    serveAddress,
+			Handler: mux,
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			if err := server.Shutdown(context.Background()); err != nil {
+				log.Println(err)
+			}
+			close(stopped)
+		}()
+
+		log.Printf("listening on %s%s", serveAddress, servePath)
+		if serveTLSCert != "" {
+			err = server.ListenAndServeTLS(serveTLSCert, serveTLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fail(err)
+		}
+		<-stopped
+		if err = handler.Close(); err != nil {
+			fail(err)
+		}
+	},
+}
+
+// The messagePrinter writes the received messages to the output and saves their attachments
+type messagePrinter struct {
+	client  *gateway.EncryptedClient
+	output  io.Writer
+	json    bool
+	saveDir string
+
+	mutex sync.Mutex
+}
+
+func (p *messagePrinter) handle(message *callback.DecryptedMessage) error {
+	attachment, err := p.saveAttachment(message)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.json {
+		return p.printJSON(message, attachment)
+	}
+	p.printText(message, attachment)
+	return nil
+}
+
+// Download the attachment of the message to the save directory.
+// Returns the path of the file or an empty string if the message has no attachment.
+func (p *messagePrinter) saveAttachment(message *callback.DecryptedMessage) (string, error) {
+	if p.saveDir == "" {
+		return "", nil
+	}
+	var (
+		content []byte
+		name    = hex.EncodeToString(message.MessageID[:])
+		err     error
+	)
+	switch m := message.Message.(type) {
+	case *gateway.FileMessage:
+		content, err = p.client.DownloadFile(m.FileID, m.SharedKey)
+		if fileName := safeFileName(m.FileName); fileName != "" {
+			name += "-" + fileName
+		}
+	case *gateway.ImageMessage:
+		content, err = p.client.DownloadImage(m.BlobID, m.Nonce, message.SenderPublicKey)
+		name += ".jpg"
+	case *gateway.VoiceMessage:
+		content, err = p.client.DownloadFile(m.BlobID, m.SharedKey)
+		name += ".mp4"
+	default:
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("download of %x failed: %w", message.MessageID[:], err)
+	}
+	path := filepath.Join(p.saveDir, name)
+	return path, ioutil.WriteFile(path, content, 0600)
+}
+
+// Reduce the file name chosen by the sender to letters, digits, '.', '_' and '-' without leading dots,
+// so it can neither leave the save directory nor contain control characters.
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r) {
+			return r
+		}
+		return -1
+	}, name)
+	return strings.TrimLeft(name, ".")
+}
+
+// A received message printed as JSON
+type printedMessage struct {
+	Message *callback.DecryptedMessage `json:"message"`
+	// The path of the saved attachment
+	Attachment string `json:"attachment,omitempty"`
+}
+
+func (p *messagePrinter) printJSON(message *callback.DecryptedMessage, attachment string) error {
+	encoded, err := json.Marshal(&printedMessage{
+		Message:    message,
+		Attachment: attachment,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(p.output, "%s\n", encoded)
+	return err
+}
+
+// Escape the control characters in a text of the sender, so it can't manipulate the terminal or fake output lines
+func escapeText(text string) string {
+	quoted := strconv.Quote(text)
+	return quoted[1 : len(quoted)-1]
+}
+
+func (p *messagePrinter) printText(message *callback.DecryptedMessage, attachment string) {
+	sender := escapeText(message.From)
+	if message.Nickname != "" {
+		sender = fmt.Sprintf("%s (%s)", sender, escapeText(message.Nickname))
+	}
+	prefix := fmt.Sprintf("[%x]", message.MessageID[:])
+
+	switch m := message.Message.(type) {
+	case *gateway.TextMessage:
+		fmt.Fprintf(p.output, "%s Text from %s: %s\n", prefix, sender, escapeText(string(m.Content)))
+	case *gateway.FileMessage:
+		fmt.Fprintf(p.output, "%s File from %s: %s (%s, %d bytes)\n", prefix, sender, escapeText(m.FileName), escapeText(m.MimeType), m.FileSize)
+	case *gateway.ImageMessage:
+		fmt.Fprintf(p.output, "%s Image from %s\n", prefix, sender)
+	case *gateway.VoiceMessage:
+		fmt.Fprintf(p.output, "%s Voice from %s (%d seconds)\n", prefix, sender, m.Seconds)
+	case *gateway.DeliveryReceiptMessage:
+		ids := make([]string, len(m.MessageIDs))
+		for i, messageID := range m.MessageIDs {
+			ids[i] = hex.EncodeToString(messageID[:])
+		}
+		fmt.Fprintf(p.output, "%s Receipt %s from %s for %s\n", prefix, m.DeliveryType, sender, strings.Join(ids, ", "))
+	default:
+		fmt.Fprintf(p.output, "%s %s from %s\n", prefix, message.Message.Type(), sender)
+	}
+	if attachment != "" {
+		fmt.Fprintf(p.output, "%s Saved to %s\n", prefix, escapeText(attachment))
+	}
+}
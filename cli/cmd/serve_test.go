@@ -0,0 +1,25 @@
+package cmd
+
+import "testing"
+
+func TestSafeFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"report-2020_v1.pdf", "report-2020_v1.pdf"},
+		{"../../etc/passwd", "etcpasswd"},
+		{"..", ""},
+		{".", ""},
+		{".bashrc", "bashrc"},
+		{`C:\Windows\evil.exe`, "CWindowsevil.exe"},
+		{"a\x00b\nc\x1b[31m.txt", "abc31m.txt"},
+		{"Prüfung 1.txt", "Prfung1.txt"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if name := safeFileName(test.name); name != test.expected {
+			t.Errorf("safeFileName(%q) = %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
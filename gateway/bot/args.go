@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var errUnterminatedQuote = errors.New("unterminated quote")
+
+// Split the command line into arguments separated by white space.
+// Arguments can be quoted with single or double quotes and characters can be escaped with a backslash.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	escaped := false
+	for _, char := range line {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '"' || char == '\'':
+			quote = char
+			inArg = true
+		case unicode.IsSpace(char):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errUnterminatedQuote
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
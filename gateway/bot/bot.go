@@ -0,0 +1,192 @@
+/*
+Package bot routes text commands received by a callback.Handler to registered handler functions.
+*/
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+// The default prefix of commands
+const DefaultPrefix = "/"
+
+// A HandlerFunc handles a command.
+// Returning an error makes the callback.Handler report a failure to the gateway, which retries the callback.
+// Errors of replies (see ReplyError) are only logged, so the command doesn't run again.
+type HandlerFunc func(ctx *Context) error
+
+// A ReplyError is returned by the methods of the Context that send a message to the sender.
+// When a handler returns it, the bot logs it instead of returning it to the callback.Handler,
+// because a retry of the callback would run the command again.
+type ReplyError struct {
+	Err error
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("reply failed: %s", e.Err)
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// A Command is a registered bot command
+type Command struct {
+	// Name of the command without prefix
+	Name string
+	// Short description shown in the help
+	Description string
+	Handler     HandlerFunc
+}
+
+// The Bot dispatches text messages starting with the prefix to the registered commands.
+type Bot struct {
+	Client *gateway.EncryptedClient
+
+	// The prefix of commands. If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Called for text messages that are not commands. If nil, the help is sent.
+	Fallback HandlerFunc
+
+	// Called for unknown commands. If nil, the help is sent.
+	NotFound HandlerFunc
+
+	// Logger for failed replies. If nil, errors are logged to stderr.
+	ErrorLog *log.Logger
+
+	mutex    sync.RWMutex
+	commands map[string]*Command
+}
+
+// Create a new bot that replies with the client. The help command is registered.
+func New(client *gateway.EncryptedClient) *Bot {
+	b := &Bot{
+		Client: client,
+	}
+	b.Command("help", "Show the available commands", func(ctx *Context) error {
+		return ctx.Reply(b.Help())
+	})
+	return b
+}
+
+func (b *Bot) prefix() string {
+	if b.Prefix != "" {
+		return b.Prefix
+	}
+	return DefaultPrefix
+}
+
+// Register the handler for the command. Command names are case insensitive.
+func (b *Bot) Command(name string, description string, handler HandlerFunc) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.commands == nil {
+		b.commands = make(map[string]*Command)
+	}
+	b.commands[strings.ToLower(name)] = &Command{
+		Name:        name,
+		Description: description,
+		Handler:     handler,
+	}
+}
+
+// Returns the registered commands sorted by name
+func (b *Bot) Commands() []*Command {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	commands := make([]*Command, 0, len(b.commands))
+	for _, command := range b.commands {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+// Returns a help text listing all commands
+func (b *Bot) Help() string {
+	var help strings.Builder
+	help.WriteString("Available commands:")
+	for _, command := range b.Commands() {
+		fmt.Fprintf(&help, "\n%s%s - %s", b.prefix(), command.Name, command.Description)
+	}
+	return help.String()
+}
+
+func (b *Bot) lookup(name string) *Command {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.commands[strings.ToLower(name)]
+}
+
+// Register the bot at the callback handler for text messages
+func (b *Bot) Register(handler *callback.Handler) {
+	handler.Handle(gateway.TypeText, b.HandleMessage)
+}
+
+func (b *Bot) logf(format string, v ...interface{}) {
+	if b.ErrorLog != nil {
+		b.ErrorLog.Printf(format, v...)
+	} else {
+		log.New(os.Stderr, "", log.LstdFlags).Printf(format, v...)
+	}
+}
+
+// HandleMessage is a callback.MessageHandlerFunc that dispatches text messages to the commands.
+// Other messages are ignored. Failed replies are logged, all other errors of the handlers are returned.
+func (b *Bot) HandleMessage(message *callback.DecryptedMessage) error {
+	err := b.handle(message)
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		b.logf("handling message %x from %s: %s", message.MessageID[:], message.From, err)
+		return nil
+	}
+	return err
+}
+
+func (b *Bot) handle(message *callback.DecryptedMessage) error {
+	textMessage, ok := message.Message.(*gateway.TextMessage)
+	if !ok {
+		return nil
+	}
+	ctx := &Context{
+		Bot:     b,
+		Message: message,
+		Text:    strings.TrimSpace(string(textMessage.Content)),
+	}
+	if !strings.HasPrefix(ctx.Text, b.prefix()) {
+		if b.Fallback != nil {
+			return b.Fallback(ctx)
+		}
+		return ctx.Reply(b.Help())
+	}
+
+	args, err := SplitArgs(strings.TrimPrefix(ctx.Text, b.prefix()))
+	if err != nil {
+		return ctx.Reply(fmt.Sprintf("Invalid command: %s", err))
+	}
+	if len(args) == 0 {
+		return ctx.Reply(b.Help())
+	}
+	ctx.Command, ctx.Args = args[0], args[1:]
+
+	command := b.lookup(ctx.Command)
+	if command == nil {
+		if b.NotFound != nil {
+			return b.NotFound(ctx)
+		}
+		return ctx.Reply(fmt.Sprintf("Unknown command %s%s\n\n%s", b.prefix(), ctx.Command, b.Help()))
+	}
+	return command.Handler(ctx)
+}
@@ -0,0 +1,100 @@
+package bot_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/bot"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"github.com/coffeemakr/threema/gateway/gatewaytest"
+)
+
+func textMessage(text string) *callback.DecryptedMessage {
+	return &callback.DecryptedMessage{
+		EncryptedMessage: &callback.EncryptedMessage{
+			From:      "ECHOECHO",
+			To:        "*TESTTST",
+			MessageID: new(gateway.MessageID),
+		},
+		Message: &gateway.TextMessage{Content: []byte(text)},
+	}
+}
+
+func TestBot(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.NewIdentity("ECHOECHO"); err != nil {
+		t.Fatal(err)
+	}
+	b := bot.New(server.NewEncryptedClient(account))
+	b.ErrorLog = log.New(ioutil.Discard, "", 0)
+	var orders [][]string
+	b.Command("order", "Order something", func(ctx *bot.Context) error {
+		orders = append(orders, ctx.Args)
+		return ctx.Replyf("Ordered %s", ctx.Arg(0))
+	})
+	failure := errors.New("failed")
+	b.Command("fail", "Fail", func(ctx *bot.Context) error {
+		return failure
+	})
+
+	if err = b.HandleMessage(textMessage(`/ORDER "green tea" 2`)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orders, [][]string{{"green tea", "2"}}) {
+		t.Errorf("unexpected orders %q", orders)
+	}
+	if sent := server.SentMessages(); len(sent) != 1 {
+		t.Fatalf("%d replies sent", len(sent))
+	}
+	reply, err := server.Decrypt(server.LastMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, ok := reply.(*gateway.TextMessage); !ok || string(text.Content) != "Ordered green tea" {
+		t.Errorf("unexpected reply %#v", reply)
+	}
+
+	// A failed reply doesn't make the gateway retry the callback, which would order again
+	server.Fail("/send_e2e", http.StatusInternalServerError)
+	if err = b.HandleMessage(textMessage("/order coffee")); err != nil {
+		t.Errorf("failed reply returned %v", err)
+	}
+	if len(orders) != 2 {
+		t.Errorf("%d orders", len(orders))
+	}
+	if err = b.HandleMessage(textMessage("/fail")); err != failure {
+		t.Errorf("expected the error of the command, got %v", err)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"", nil},
+		{"  order  tea ", []string{"order", "tea"}},
+		{`say "hello world" 'it''s'`, []string{"say", "hello world", "its"}},
+		{`a\ b "c\"d"`, []string{"a b", `c"d`}},
+		{`empty ""`, []string{"empty", ""}},
+	}
+	for _, test := range tests {
+		args, err := bot.SplitArgs(test.line)
+		if err != nil || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("SplitArgs(%q) = %q, %v", test.line, args, err)
+		}
+	}
+	if _, err := bot.SplitArgs(`say "hello`); err == nil {
+		t.Error("unterminated quote was accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"fmt"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+// The Context of a received message
+type Context struct {
+	Bot *Bot
+	// The received message
+	Message *callback.DecryptedMessage
+	// The trimmed text of the message
+	Text string
+	// The command name without prefix. Empty if the message is not a command.
+	Command string
+	// The arguments of the command
+	Args []string
+}
+
+// Returns the identity of the sender
+func (c *Context) Sender() string {
+	return c.Message.From
+}
+
+// Returns the argument at the index or an empty string if there is no such argument
+func (c *Context) Arg(index int) string {
+	if index < 0 || index >= len(c.Args) {
+		return ""
+	}
+	return c.Args[index]
+}
+
+// Wrap the error of a sent message in a ReplyError
+func replyError(err error) error {
+	if err != nil {
+		return &ReplyError{Err: err}
+	}
+	return nil
+}
+
+// Send a text message to the sender. Errors are returned as ReplyError.
+func (c *Context) Reply(text string) error {
+	_, err := c.Bot.Client.SendTextMessage(c.Sender(), text)
+	return replyError(err)
+}
+
+// Send a formatted text message to the sender
+func (c *Context) Replyf(format string, args ...interface{}) error {
+	return c.Reply(fmt.Sprintf(format, args...))
+}
+
+// Send a file to the sender. Errors are returned as ReplyError.
+func (c *Context) ReplyFile(file gateway.File, description string) error {
+	_, err := c.Bot.Client.SendFile(c.Sender(), file, description)
+	return replyError(err)
+}
+
+// React to the received message with a delivery receipt,
+// usually gateway.DeliveryAcknowledged or gateway.DeliveryDeclined. Errors are returned as ReplyError.
+func (c *Context) React(deliveryType gateway.DeliveryReceiptType) error {
+	_, err := c.Bot.Client.SendDeliveryReceipt(c.Sender(), deliveryType, c.Message.MessageID)
+	return replyError(err)
+}
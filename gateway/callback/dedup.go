@@ -0,0 +1,78 @@
+package callback
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrClockSkew = errors.New("message date is outside of the allowed clock skew")
+
+// ErrInFlight is returned for a callback that is still being processed by an earlier delivery.
+var ErrInFlight = errors.New("message is already being processed")
+
+// A SeenStore remembers which callbacks were already processed.
+type SeenStore interface {
+	// Seen reports whether the key was added.
+	Seen(key string) (bool, error)
+	// Add records the key after the callback was processed successfully.
+	Add(key string) error
+}
+
+// Returns the key that identifies the message for deduplication: the sender and the message ID.
+func (m *EncryptedMessage) DeduplicationKey() string {
+	return m.From + ":" + hex.EncodeToString(m.MessageID[:])
+}
+
+// Check that the date of the message differs at most maxSkew from now.
+func CheckDate(message *EncryptedMessage, maxSkew time.Duration, now time.Time) error {
+	skew := now.Sub(message.Date)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return fmt.Errorf("%w: %s", ErrClockSkew, skew)
+	}
+	return nil
+}
+
+type memorySeenStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// Create a SeenStore that keeps the keys in memory for the duration of ttl.
+func NewMemorySeenStore(ttl time.Duration) SeenStore {
+	return &memorySeenStore{
+		ttl:       ttl,
+		seen:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *memorySeenStore) Seen(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	added, ok := s.seen[key]
+	return ok && time.Since(added) <= s.ttl, nil
+}
+
+func (s *memorySeenStore) Add(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.ttl {
+		for seenKey, added := range s.seen {
+			if now.Sub(added) > s.ttl {
+				delete(s.seen, seenKey)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.seen[key] = now
+	return nil
+}
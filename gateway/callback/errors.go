@@ -0,0 +1,32 @@
+package callback
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMethodNotAllowed = errors.New("callback request method must be POST")
+	ErrRequestTooLarge  = errors.New("callback request body is too large")
+	// The mac of the callback doesn't match. The request was not sent by the gateway or was modified.
+	ErrInvalidMAC = errors.New("mac does not match")
+)
+
+// A ValidationError is returned if a field of the callback request is missing or malformed.
+type ValidationError struct {
+	// The name of the invalid form field
+	Field string
+	// Describes why the field is invalid
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid parameter %s: %s", e.Field, e.Reason)
+}
+
+func invalidField(field string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
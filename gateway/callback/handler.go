@@ -0,0 +1,505 @@
+package callback
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+)
+
+const (
+	// The default number of callbacks that are processed concurrently by the Handler
+	DefaultMaxConcurrent = 8
+	// The default delay before messages in the journal are processed again after a failure
+	DefaultRetryInterval = 30 * time.Second
+	// The default number of attempts to process a message of the journal before it is moved to the dead letters
+	DefaultMaxAttempts = 10
+
+	// The delay between attempts doubles after every failure, up to this factor of the retry interval
+	maxBackoffFactor = 64
+)
+
+// A permanentError fails every time the message is processed, for example because the box can't be decrypted
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// A MessageHandlerFunc processes a decrypted message.
+// If an error is returned, the gateway is told to deliver the callback again later.
+type MessageHandlerFunc func(message *DecryptedMessage) error
+
+// The Handler is a http.Handler for the callback URL of the gateway.
+// It verifies the MAC of the callback, decrypts the message and dispatches it to
+// the handler registered for its type. Messages that can't be decrypted or whose sender is unknown
+// are logged and acknowledged, because a retry of the gateway would fail again.
+type Handler struct {
+	// The client used to decrypt the messages. The API secret of the client is used to verify the MAC.
+	Client *gateway.EncryptedClient
+
+	// The maximum number of callbacks processed at the same time. Further requests wait for a free slot
+	// and get a 503 response if their context times out before.
+	// If zero, DefaultMaxConcurrent is used.
+	MaxConcurrent int
+
+	// If set, callbacks with a sender and message ID that were already processed are acknowledged
+	// without processing them again. A callback is only recorded after its handler succeeded;
+	// a retry that arrives while the message is still being processed is rejected with 503.
+	SeenStore SeenStore
+
+	// If greater than zero, callbacks with a message date that differs more from the current time are rejected.
+	MaxClockSkew time.Duration
+
+	// If set, verified callbacks are written to the journal before the gateway is acknowledged
+	// and processed asynchronously with at-least-once semantics. Start must be called to process
+	// the messages, including the ones left over from a previous run.
+	Journal *Journal
+
+	// The delay before messages in the journal are processed again after a failure.
+	// The delay doubles with every failed attempt. If zero, DefaultRetryInterval is used.
+	RetryInterval time.Duration
+
+	// The number of attempts to process a message of the journal. Messages that still fail and messages
+	// that can never be processed, because they can't be read or decrypted, are moved to the dead letters
+	// of the journal. If zero, DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// If set, a DeliveryReceived receipt is sent for every message that is not a delivery receipt
+	// after its handler returned without an error.
+	SendReceivedReceipts bool
+
+	// If set, a DeliveryRead receipt is sent for every message that is not a delivery receipt
+	// after its handler returned without an error.
+	SendReadReceipts bool
+
+	// Receipts to the same sender within this delay are combined into one message.
+	// If zero, DefaultReceiptDelay is used.
+	ReceiptDelay time.Duration
+
+	// Logger for errors. If nil, errors are logged to stderr.
+	ErrorLog *log.Logger
+
+	mutex          sync.RWMutex
+	handlers       map[gateway.MessageType]MessageHandlerFunc
+	defaultHandler MessageHandlerFunc
+
+	initOnce sync.Once
+	slots    chan struct{}
+
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+	inFlight map[string]bool
+	attempts map[string]*journalAttempts
+	// The deduplication keys of the messages being processed
+	processing map[string]bool
+	receipts   *receiptBatcher
+}
+
+// Create a new callback Handler which decrypts the messages with the client.
+func NewHandler(client *gateway.EncryptedClient) *Handler {
+	return &Handler{
+		Client: client,
+	}
+}
+
+func (h *Handler) init() {
+	h.initOnce.Do(func() {
+		maxConcurrent := h.MaxConcurrent
+		if maxConcurrent <= 0 {
+			maxConcurrent = DefaultMaxConcurrent
+		}
+		h.slots = make(chan struct{}, maxConcurrent)
+		h.wake = make(chan struct{}, 1)
+		h.stop = make(chan struct{})
+		h.inFlight = make(map[string]bool)
+		h.attempts = make(map[string]*journalAttempts)
+		h.processing = make(map[string]bool)
+		receiptDelay := h.ReceiptDelay
+		if receiptDelay <= 0 {
+			receiptDelay = DefaultReceiptDelay
+		}
+		h.receipts = newReceiptBatcher(h.Client, receiptDelay, h.logf)
+	})
+}
+
+func (h *Handler) logf(format string, v ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, v...)
+	} else {
+		log.New(os.Stderr, "", log.LstdFlags).Printf(format, v...)
+	}
+}
+
+// Register the handler function for messages of the type.
+func (h *Handler) Handle(messageType gateway.MessageType, handler MessageHandlerFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.handlers == nil {
+		h.handlers = make(map[gateway.MessageType]MessageHandlerFunc)
+	}
+	h.handlers[messageType] = handler
+}
+
+// Register the handler function for all messages without a handler for their type.
+func (h *Handler) HandleDefault(handler MessageHandlerFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.defaultHandler = handler
+}
+
+func (h *Handler) handlerFor(messageType gateway.MessageType) MessageHandlerFunc {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if handler, ok := h.handlers[messageType]; ok {
+		return handler
+	}
+	return h.defaultHandler
+}
+
+// Decrypt the message and pass it to the registered handler
+func (h *Handler) process(encrypted *EncryptedMessage) error {
+	publicKey, err := h.Client.LookupPublicKey(encrypted.From)
+	if err == gateway.ErrIDNotFound {
+		return &permanentError{err}
+	} else if err != nil {
+		return err
+	}
+	message, err := h.Client.EncryptionHelper.DecryptMessage(encrypted.Box, publicKey, encrypted.Nonce)
+	if err == gateway.ErrKeyDestroyed {
+		return err
+	} else if err != nil {
+		return &permanentError{err}
+	}
+	sendReceipts := message.Type() != gateway.TypeDeliveryReceipt
+	if handler := h.handlerFor(message.Type()); handler != nil {
+		err = handler(&DecryptedMessage{
+			EncryptedMessage: encrypted,
+			Message:          message,
+			SenderPublicKey:  publicKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Receipts are only sent once the message was processed, so a retry doesn't send them twice
+	if sendReceipts && h.SendReceivedReceipts {
+		h.receipts.add(encrypted.From, gateway.DeliveryReceived, encrypted.MessageID)
+	}
+	if sendReceipts && h.SendReadReceipts {
+		h.receipts.add(encrypted.From, gateway.DeliveryRead, encrypted.MessageID)
+	}
+	return nil
+}
+
+// Process the message unless the SeenStore reports it as already processed.
+// ErrInFlight is returned if the same message is processed at the moment.
+func (h *Handler) processOnce(encrypted *EncryptedMessage) error {
+	if h.SeenStore == nil {
+		return h.process(encrypted)
+	}
+	key := encrypted.DeduplicationKey()
+	if !h.startProcessing(key) {
+		return ErrInFlight
+	}
+	defer h.stopProcessing(key)
+
+	seen, err := h.SeenStore.Seen(key)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return nil
+	}
+	if err = h.process(encrypted); err != nil {
+		return err
+	}
+	if err = h.SeenStore.Add(key); err != nil {
+		// The message was processed, a retry would process it again
+		h.logf("failed to record message %s as processed: %s", key, err)
+	}
+	return nil
+}
+
+func (h *Handler) startProcessing(key string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.processing[key] {
+		return false
+	}
+	h.processing[key] = true
+	return true
+}
+
+func (h *Handler) stopProcessing(key string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.processing, key)
+}
+
+// Respond with the status code matching the error returned by ReadMessage
+func (h *Handler) writeReadError(w http.ResponseWriter, err error) {
+	var validationError *ValidationError
+	switch {
+	case errors.Is(err, ErrMethodNotAllowed):
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case errors.Is(err, ErrInvalidMAC):
+		http.Error(w, "invalid mac", http.StatusForbidden)
+	case errors.Is(err, ErrRequestTooLarge):
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+	case errors.As(err, &validationError):
+		http.Error(w, validationError.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.init()
+
+	encrypted, err := ReadMessage(r, h.Client.Client.Secret)
+	if err != nil {
+		if errors.Is(err, ErrInvalidMAC) {
+			h.logf("callback request from %s with invalid mac", r.RemoteAddr)
+		} else {
+			h.logf("invalid callback request: %s", err)
+		}
+		h.writeReadError(w, err)
+		return
+	}
+
+	if h.MaxClockSkew > 0 {
+		if err = CheckDate(encrypted, h.MaxClockSkew, time.Now()); err != nil {
+			h.logf("rejected callback for message %x from %s: %s", encrypted.MessageID[:], encrypted.From, err)
+			http.Error(w, "invalid date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if h.Journal != nil {
+		if _, err = h.Journal.Append(encrypted); err != nil {
+			h.logf("failed to write message %x from %s to the journal: %s", encrypted.MessageID[:], encrypted.From, err)
+			http.Error(w, "processing failed", http.StatusInternalServerError)
+			return
+		}
+		h.notify()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	case <-r.Context().Done():
+		if r.Context().Err() == context.DeadlineExceeded {
+			// The request timed out while all slots were taken
+			http.Error(w, "too many requests", http.StatusServiceUnavailable)
+		}
+		// Otherwise the gateway closed the connection and doesn't read a response
+		return
+	}
+	err = h.processOnce(encrypted)
+	<-h.slots
+
+	if errors.Is(err, ErrInFlight) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "message is being processed", http.StatusServiceUnavailable)
+		return
+	}
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		// A retry of the gateway would fail again, so the message is dropped
+		h.logf("processing message %x from %s failed permanently, dropping it: %s", encrypted.MessageID[:], encrypted.From, err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		h.logf("processing message %x from %s failed: %s", encrypted.MessageID[:], encrypted.From, err)
+		http.Error(w, "processing failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Start processing the messages in the journal, including the messages left over from a previous run.
+func (h *Handler) Start() error {
+	if h.Journal == nil {
+		return errors.New("handler has no journal")
+	}
+	h.init()
+	h.workers.Add(1)
+	go h.dispatch()
+	h.notify()
+	return nil
+}
+
+// Stop processing the messages in the journal and wait until the running handlers are finished.
+// Messages that were not processed yet stay in the journal. Pending delivery receipts are sent.
+func (h *Handler) Close() error {
+	h.init()
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+	h.workers.Wait()
+	h.receipts.flush()
+	return nil
+}
+
+func (h *Handler) notify() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Handler) retryInterval() time.Duration {
+	if h.RetryInterval > 0 {
+		return h.RetryInterval
+	}
+	return DefaultRetryInterval
+}
+
+// Pass the messages of the journal to the workers until the handler is closed.
+func (h *Handler) dispatch() {
+	defer h.workers.Done()
+	retry := time.NewTicker(h.retryInterval())
+	defer retry.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-h.wake:
+		case <-retry.C:
+		}
+		ids, err := h.Journal.Pending()
+		if err != nil {
+			h.logf("failed to read the journal: %s", err)
+			continue
+		}
+		for _, id := range ids {
+			if !h.claim(id) {
+				continue
+			}
+			select {
+			case h.slots <- struct{}{}:
+			case <-h.stop:
+				return
+			}
+			h.workers.Add(1)
+			go h.processEntry(id)
+		}
+	}
+}
+
+type journalAttempts struct {
+	count int
+	next  time.Time
+}
+
+func (h *Handler) maxAttempts() int {
+	if h.MaxAttempts > 0 {
+		return h.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+// Record a failed attempt to process the entry. Returns false if no attempts are left.
+func (h *Handler) failedAttempt(id string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	attempts := h.attempts[id]
+	if attempts == nil {
+		attempts = new(journalAttempts)
+		h.attempts[id] = attempts
+	}
+	attempts.count++
+	if attempts.count >= h.maxAttempts() {
+		return false
+	}
+	factor := 1 << uint(attempts.count-1)
+	if factor > maxBackoffFactor {
+		factor = maxBackoffFactor
+	}
+	attempts.next = time.Now().Add(time.Duration(factor) * h.retryInterval())
+	return true
+}
+
+// Mark the journal entry as in progress. Returns false if it is already processed
+// or if its next attempt is not due yet.
+func (h *Handler) claim(id string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.inFlight[id] {
+		return false
+	}
+	if attempts := h.attempts[id]; attempts != nil && time.Now().Before(attempts.next) {
+		return false
+	}
+	h.inFlight[id] = true
+	return true
+}
+
+func (h *Handler) release(id string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.inFlight, id)
+}
+
+func (h *Handler) processEntry(id string) {
+	defer h.workers.Done()
+	defer func() { <-h.slots }()
+	defer h.release(id)
+
+	encrypted, err := h.Journal.Read(id)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		h.logf("failed to read journal entry %s: %s", id, err)
+		h.deadLetter(id, err)
+		return
+	}
+	if err = h.processOnce(encrypted); err != nil {
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			h.logf("processing message %x from %s failed permanently: %s", encrypted.MessageID[:], encrypted.From, err)
+			h.deadLetter(id, err)
+		} else if !h.failedAttempt(id) {
+			h.logf("processing message %x from %s failed too often: %s", encrypted.MessageID[:], encrypted.From, err)
+			h.deadLetter(id, err)
+		} else {
+			h.logf("processing message %x from %s failed, retrying later: %s", encrypted.MessageID[:], encrypted.From, err)
+		}
+		return
+	}
+	h.forgetAttempts(id)
+	if err = h.Journal.Remove(id); err != nil {
+		h.logf("failed to remove journal entry %s: %s", id, err)
+	}
+}
+
+func (h *Handler) forgetAttempts(id string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.attempts, id)
+}
+
+// Move the entry to the dead letters, so it's not processed again
+func (h *Handler) deadLetter(id string, reason error) {
+	h.forgetAttempts(id)
+	if err := h.Journal.DeadLetter(id, reason); err != nil {
+		h.logf("failed to move journal entry %s to the dead letters: %s", id, err)
+	}
+}
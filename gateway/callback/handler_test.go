@@ -0,0 +1,329 @@
+package callback_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"github.com/coffeemakr/threema/gateway/gatewaytest"
+)
+
+func TestHandler(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := server.NewIdentity("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := callback.NewHandler(server.NewEncryptedClient(account))
+	handler.SeenStore = callback.NewMemorySeenStore(time.Hour)
+	received := make(chan string, 10)
+	handler.Handle(gateway.TypeText, func(message *callback.DecryptedMessage) error {
+		received <- string(message.Message.(*gateway.TextMessage).Content)
+		return nil
+	})
+
+	response, err := server.SendCallback(handler, sender, account, &gateway.TextMessage{Content: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+	if text := <-received; text != "Hello" {
+		t.Errorf("unexpected text %q", text)
+	}
+
+	forged := &gatewaytest.Account{Identity: account.Identity, Secret: "wrong"}
+	response, err = server.SendCallback(handler, sender, forged, &gateway.TextMessage{Content: []byte("Forged")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("forged callback got status %d", response.StatusCode)
+	}
+	if len(received) != 0 {
+		t.Error("forged callback was dispatched")
+	}
+}
+
+func TestHandlerDuplicateInFlight(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := server.NewIdentity("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := server.CallbackRequest("http://localhost/callback", sender, account, &gateway.TextMessage{Content: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver := func(handler http.Handler) int {
+		recorder := httptest.NewRecorder()
+		retry := httptest.NewRequest(http.MethodPost, "/callback", bytes.NewReader(body))
+		retry.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(recorder, retry)
+		return recorder.Code
+	}
+
+	handler := callback.NewHandler(server.NewEncryptedClient(account))
+	handler.SeenStore = callback.NewMemorySeenStore(time.Hour)
+	started, release := make(chan struct{}), make(chan error)
+	calls := 0
+	handler.HandleDefault(func(message *callback.DecryptedMessage) error {
+		calls++
+		started <- struct{}{}
+		return <-release
+	})
+
+	first := make(chan int)
+	go func() { first <- deliver(handler) }()
+	<-started
+	if status := deliver(handler); status != http.StatusServiceUnavailable {
+		t.Errorf("duplicate in flight got status %d", status)
+	}
+	release <- errors.New("failed")
+	if status := <-first; status != http.StatusInternalServerError {
+		t.Errorf("failed delivery got status %d", status)
+	}
+
+	// The failed message is processed again when the gateway retries
+	go func() { first <- deliver(handler) }()
+	<-started
+	release <- nil
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("retry got status %d", status)
+	}
+	if status := deliver(handler); status != http.StatusOK || calls != 2 {
+		t.Errorf("duplicate got status %d after %d calls", status, calls)
+	}
+}
+
+func TestHandlerFullPool(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := server.NewIdentity("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := callback.NewHandler(server.NewEncryptedClient(account))
+	handler.MaxConcurrent = 1
+	started, release := make(chan struct{}), make(chan struct{})
+	handler.HandleDefault(func(message *callback.DecryptedMessage) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	done := make(chan struct{})
+	go func() {
+		_, _ = server.SendCallback(handler, sender, account, &gateway.TextMessage{Content: []byte("first")})
+		close(done)
+	}()
+	<-started
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	deliver := func(ctx context.Context) *httptest.ResponseRecorder {
+		request, err := server.CallbackRequest("http://localhost/callback", sender, account, &gateway.TextMessage{Content: []byte("second")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request.WithContext(ctx))
+		return recorder
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	if recorder := deliver(timeout); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("timed out request got status %d", recorder.Code)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if recorder := deliver(canceled); recorder.Body.Len() != 0 {
+		t.Errorf("canceled request got response %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestHandlerReceiptsAfterSuccess(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := server.NewIdentity("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := callback.NewHandler(server.NewEncryptedClient(account))
+	handler.SendReceivedReceipts = true
+	handler.HandleDefault(func(message *callback.DecryptedMessage) error {
+		return errors.New("failed")
+	})
+
+	if _, err = server.SendCallback(handler, sender, account, &gateway.TextMessage{Content: []byte("Hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = handler.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := server.SentMessages(); len(sent) != 0 {
+		t.Fatalf("%d receipts sent for a failed message", len(sent))
+	}
+
+	handler = callback.NewHandler(server.NewEncryptedClient(account))
+	handler.SendReceivedReceipts = true
+	handler.HandleDefault(func(message *callback.DecryptedMessage) error { return nil })
+	if _, err = server.SendCallback(handler, sender, account, &gateway.TextMessage{Content: []byte("Hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = handler.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sent := server.SentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("%d receipts sent", len(sent))
+	}
+	message, err := server.Decrypt(sent[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt, ok := message.(*gateway.DeliveryReceiptMessage); !ok || receipt.DeliveryType != gateway.DeliveryReceived {
+		t.Errorf("unexpected message %#v", message)
+	}
+}
+
+func TestHandlerJournalDeadLetters(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := server.NewIdentity("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := gatewaytest.NewIdentity("UNKNOWN1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal, err := callback.OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "0-corrupt.callback"), []byte("from=%zz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := callback.NewHandler(server.NewEncryptedClient(account))
+	handler.Journal = journal
+	handler.RetryInterval = time.Millisecond
+	handler.MaxAttempts = 3
+	attempts := make(chan struct{}, 10)
+	handler.HandleDefault(func(message *callback.DecryptedMessage) error {
+		attempts <- struct{}{}
+		return errors.New("failed")
+	})
+	for _, from := range []*gatewaytest.Identity{unknown, sender} {
+		response, err := server.SendCallback(handler, from, account, &gateway.TextMessage{Content: []byte("Hello")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d", response.StatusCode)
+		}
+	}
+	if err = handler.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := journal.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries left in the journal", len(pending))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err = handler.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 {
+		t.Errorf("failing message was processed %d times", len(attempts))
+	}
+	dead, err := filepath.Glob(filepath.Join(dir, "dead", "*.callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 3 {
+		t.Errorf("%d dead letters", len(dead))
+	}
+}
+
+func TestHandlerDropsPermanentFailures(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := gatewaytest.NewIdentity("UNKNOWN1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := callback.NewHandler(server.NewEncryptedClient(account))
+	handler.ErrorLog = log.New(ioutil.Discard, "", 0)
+	handler.HandleDefault(func(message *callback.DecryptedMessage) error {
+		t.Error("message of unknown sender was dispatched")
+		return nil
+	})
+	response, err := server.SendCallback(handler, unknown, account, &gateway.TextMessage{Content: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("unknown sender got status %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,158 @@
+package callback
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	journalEntrySuffix = ".callback"
+	journalErrorSuffix = ".error"
+	journalTempPrefix  = ".tmp-"
+	// The subdirectory of the journal with the messages that could not be processed
+	journalDeadLetterDir = "dead"
+)
+
+// A Journal persists verified callbacks in a directory until they are processed.
+// Every message is stored in its own file, which is removed after the message was processed.
+type Journal struct {
+	dir string
+
+	mutex    sync.Mutex
+	sequence uint64
+}
+
+// Open the journal in the directory. The directory is created if it doesn't exist.
+// Incomplete entries of a previous run are removed.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	tempFiles, err := filepath.Glob(filepath.Join(dir, journalTempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tempFile := range tempFiles {
+		if err = os.Remove(tempFile); err != nil {
+			return nil, err
+		}
+	}
+	return &Journal{
+		dir: dir,
+	}, nil
+}
+
+func (j *Journal) nextName() string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.sequence++
+	// The names sort in the order the messages were appended
+	return fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), j.sequence, journalEntrySuffix)
+}
+
+// Append the message to the journal. When Append returns without an error,
+// the message was written to disk and survives a crash.
+func (j *Journal) Append(message *EncryptedMessage) (id string, err error) {
+	id = j.nextName()
+	tempFile, err := ioutil.TempFile(j.dir, journalTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	tempName := tempFile.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tempName)
+		}
+	}()
+	if _, err = tempFile.WriteString(formValues(message).Encode()); err != nil {
+		_ = tempFile.Close()
+		return "", err
+	}
+	if err = tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		return "", err
+	}
+	if err = tempFile.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tempName, filepath.Join(j.dir, id)); err != nil {
+		return "", err
+	}
+	return id, j.syncDir()
+}
+
+// Sync the directory, so the renamed entry is persisted
+func (j *Journal) syncDir() error {
+	dir, err := os.Open(j.dir)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Returns the IDs of all messages in the journal, the oldest first.
+func (j *Journal) Pending() ([]string, error) {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), journalEntrySuffix) {
+			ids = append(ids, file.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Read the message with the ID from the journal.
+func (j *Journal) Read(id string) (*EncryptedMessage, error) {
+	content, err := ioutil.ReadFile(j.path(id))
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return parseFields(values)
+}
+
+// Remove the message with the ID from the journal after it was processed.
+func (j *Journal) Remove(id string) error {
+	return os.Remove(j.path(id))
+}
+
+// Move the message with the ID to the dead letters, because it could not be processed.
+// The reason is written next to the message. Dead letters are kept in the subdirectory "dead"
+// of the journal and are not returned by Pending.
+func (j *Journal) DeadLetter(id string, reason error) error {
+	dir := filepath.Join(j.dir, journalDeadLetterDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Base(id)
+	if err := ioutil.WriteFile(filepath.Join(dir, name+journalErrorSuffix), []byte(reason.Error()+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path(id), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return j.syncDir()
+}
+
+func (j *Journal) path(id string) string {
+	return filepath.Join(j.dir, filepath.Base(id))
+}
@@ -0,0 +1,119 @@
+package callback
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+)
+
+type jsonEncryptedMessage struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	MessageID string    `json:"messageId"`
+	Date      time.Time `json:"date"`
+	Nonce     string    `json:"nonce"`
+	Box       []byte    `json:"box"`
+	Mac       string    `json:"mac,omitempty"`
+	Nickname  string    `json:"nickname,omitempty"`
+}
+
+func (m *EncryptedMessage) toJSON() *jsonEncryptedMessage {
+	value := &jsonEncryptedMessage{
+		From:     m.From,
+		To:       m.To,
+		Date:     m.Date,
+		Box:      m.Box,
+		Nickname: m.Nickname,
+	}
+	if m.MessageID != nil {
+		value.MessageID = hex.EncodeToString(m.MessageID[:])
+	}
+	if m.Nonce != nil {
+		value.Nonce = hex.EncodeToString(m.Nonce[:])
+	}
+	if m.Mac != nil {
+		value.Mac = hex.EncodeToString(m.Mac)
+	}
+	return value
+}
+
+func (m *EncryptedMessage) fromJSON(value *jsonEncryptedMessage) (err error) {
+	m.From = value.From
+	m.To = value.To
+	m.Date = value.Date
+	m.Box = value.Box
+	m.Nickname = value.Nickname
+	if m.MessageID, err = gateway.ReadMessageIDFromHex(value.MessageID); err != nil {
+		return
+	}
+	if m.Nonce, err = gateway.ReadHexNonce(value.Nonce); err != nil {
+		return
+	}
+	m.Mac = nil
+	if value.Mac != "" {
+		m.Mac, err = hex.DecodeString(value.Mac)
+	}
+	return
+}
+
+// The message ID, nonce and mac are hex encoded, the box is base64 encoded.
+func (m *EncryptedMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.toJSON())
+}
+
+func (m *EncryptedMessage) UnmarshalJSON(data []byte) error {
+	var value jsonEncryptedMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return m.fromJSON(&value)
+}
+
+type jsonDecryptedMessage struct {
+	*jsonEncryptedMessage
+	Message         json.RawMessage `json:"message"`
+	SenderPublicKey string          `json:"senderPublicKey,omitempty"`
+}
+
+// The decrypted message is encoded with gateway.MarshalMessage.
+// The fields of the encrypted message are omitted if it is nil.
+func (m *DecryptedMessage) MarshalJSON() ([]byte, error) {
+	value := new(jsonDecryptedMessage)
+	if m.EncryptedMessage != nil {
+		value.jsonEncryptedMessage = m.EncryptedMessage.toJSON()
+	}
+	if m.Message != nil {
+		message, err := gateway.MarshalMessage(m.Message)
+		if err != nil {
+			return nil, err
+		}
+		value.Message = message
+	}
+	if m.SenderPublicKey != nil {
+		value.SenderPublicKey = hex.EncodeToString(m.SenderPublicKey[:])
+	}
+	return json.Marshal(value)
+}
+
+func (m *DecryptedMessage) UnmarshalJSON(data []byte) (err error) {
+	value := jsonDecryptedMessage{
+		jsonEncryptedMessage: new(jsonEncryptedMessage),
+	}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return
+	}
+	m.EncryptedMessage = new(EncryptedMessage)
+	if err = m.EncryptedMessage.fromJSON(value.jsonEncryptedMessage); err != nil {
+		return
+	}
+	if m.Message, err = gateway.UnmarshalMessage(value.Message); err != nil {
+		return
+	}
+	m.SenderPublicKey = nil
+	if value.SenderPublicKey != "" {
+		m.SenderPublicKey, err = gateway.ReadHexPublicKey(value.SenderPublicKey)
+	}
+	return
+}
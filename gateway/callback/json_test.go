@@ -0,0 +1,42 @@
+package callback_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+func TestDecryptedMessageJSON(t *testing.T) {
+	message := &callback.DecryptedMessage{
+		EncryptedMessage: &callback.EncryptedMessage{
+			From:      "ECHOECHO",
+			To:        "*TESTTST",
+			MessageID: &gateway.MessageID{1, 2, 3, 4, 5, 6, 7, 8},
+			Date:      time.Unix(1600000000, 0).UTC(),
+			Nonce:     new(gateway.Nonce),
+			Box:       []byte{1, 2, 3},
+		},
+		Message: &gateway.TextMessage{Content: []byte("Hello")},
+	}
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(callback.DecryptedMessage)
+	if err = json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.From != "ECHOECHO" || *decoded.MessageID != *message.MessageID || !decoded.Date.Equal(message.Date) {
+		t.Errorf("unexpected message %s", encoded)
+	}
+	if text, ok := decoded.Message.(*gateway.TextMessage); !ok || string(text.Content) != "Hello" {
+		t.Errorf("unexpected content %#v", decoded.Message)
+	}
+
+	if _, err = json.Marshal(&callback.DecryptedMessage{Message: message.Message}); err != nil {
+		t.Errorf("message without encrypted message: %s", err)
+	}
+}
@@ -31,3 +31,14 @@ type EncryptedMessage struct {
 	// nickname public nickname of the sender, if set
 	Nickname string
 }
+
+// DecryptedMessage is a received message after the MAC was verified and the box was decrypted
+type DecryptedMessage struct {
+	*EncryptedMessage
+
+	// The decrypted message
+	Message gateway.Message
+
+	// The public key of the sender, which was used to decrypt the message
+	SenderPublicKey *gateway.PublicKey
+}
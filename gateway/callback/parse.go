@@ -4,9 +4,11 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"github.com/coffeemakr/threema/gateway"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -19,12 +21,21 @@ const (
 	messageIDByteLength = 8
 	boxByteMaxLength    = 4000
 	macByteLength       = 32
+	nicknameMaxLength   = 32
+
+	// The maximum size of the request body. This leaves enough room for the
+	// hex encoded box and all other fields.
+	MaxRequestBodyBytes = 2*boxByteMaxLength + 1024
 )
 
+// The form fields of a callback request
+var callbackFields = []string{"from", "to", "messageId", "date", "nonce", "box", "mac", "nickname"}
+
 func parseDateString(rawDate string) (result time.Time, err error) {
 	var timestamp int64
 	timestamp, err = strconv.ParseInt(rawDate, 10, 64)
 	if err != nil {
+		err = invalidField("date", "not a unix timestamp")
 		return
 	}
 	result = time.Unix(timestamp, 0)
@@ -33,102 +44,156 @@ func parseDateString(rawDate string) (result time.Time, err error) {
 
 func parseMac(rawValue string) ([]byte, error) {
 	if len(rawValue) != (2 * macByteLength) {
-		return nil, fmt.Errorf("expected mac length %d (in hex) but got %d", 2 * macByteLength, len(rawValue))
+		return nil, invalidField("mac", "expected length %d (in hex) but got %d", 2*macByteLength, len(rawValue))
 	}
-	return hex.DecodeString(rawValue)
+	mac, err := hex.DecodeString(rawValue)
+	if err != nil {
+		return nil, invalidField("mac", "not hex encoded")
+	}
+	return mac, nil
+}
+
+func parseBox(rawValue string) ([]byte, error) {
+	if rawValue == "" {
+		return nil, invalidField("box", "empty parameter")
+	}
+	if len(rawValue) > 2*boxByteMaxLength {
+		return nil, invalidField("box", "longer than %d bytes", boxByteMaxLength)
+	}
+	box, err := hex.DecodeString(rawValue)
+	if err != nil {
+		return nil, invalidField("box", "not hex encoded")
+	}
+	return box, nil
+}
+
+// Read the url encoded form from the request body.
+// Callback fields in the query string are rejected, so they can't override the body.
+func readForm(r *http.Request) (url.Values, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("%w: got %s", ErrMethodNotAllowed, r.Method)
+	}
+	query := r.URL.Query()
+	for _, field := range callbackFields {
+		if _, ok := query[field]; ok {
+			return nil, invalidField(field, "must be in the request body and not in the query")
+		}
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil, invalidField("Content-Type", "must be application/x-www-form-urlencoded")
+	}
+	if r.ContentLength > MaxRequestBodyBytes {
+		return nil, ErrRequestTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxRequestBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxRequestBodyBytes {
+		return nil, ErrRequestTooLarge
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, invalidField("body", "malformed form: %s", err)
+	}
+	return values, nil
 }
 
 func getStringWithFixedLength(values url.Values, key string, requiredLength int) (string, error) {
 	value := values.Get(key)
 	if value == "" {
-		return "", fmt.Errorf("empty parameter %s", key)
+		return "", invalidField(key, "empty parameter")
 	}
 	if len(value) != requiredLength {
-		return "", fmt.Errorf("required length not met in %s", key)
+		return "", invalidField(key, "required length %d not met", requiredLength)
 	}
 	return value, nil
 }
 
+// The fields covered by the mac, in the order they are authenticated
+var macFields = []string{"from", "to", "messageId", "date", "nonce", "box"}
+
+// Calculate the mac of the callback fields with the API secret
+func calculateMac(values url.Values, apiSecret string) []byte {
+	calculatedMac := hmac.New(sha256.New, []byte(apiSecret))
+	for _, field := range macFields {
+		calculatedMac.Write([]byte(values.Get(field)))
+	}
+	return calculatedMac.Sum(nil)
+}
+
+// Verify the mac of the callback fields.
+// ErrInvalidMAC is returned if the mac doesn't match.
+func VerifyMac(values url.Values, apiSecret string) error {
+	mac, err := parseMac(values.Get("mac"))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(calculateMac(values, apiSecret), mac) {
+		return ErrInvalidMAC
+	}
+	return nil
+}
+
 // read message from a request to the callback.
 // This checks the request method and the mac to determine if the message is valid.
-func ReadMessage(r *http.Request, apiSecret string) (message *EncryptedMessage, err error) {
-	if r.Method != http.MethodPost {
-		return nil, fmt.Errorf("invalid request method %s", r.Method)
+// Errors in the request are returned as *ValidationError, ErrMethodNotAllowed, ErrRequestTooLarge
+// or ErrInvalidMAC. A message is only returned if the request is valid.
+func ReadMessage(r *http.Request, apiSecret string) (*EncryptedMessage, error) {
+	form, err := readForm(r)
+	if err != nil {
+		return nil, err
 	}
-	calculatedMac := hmac.New(sha256.New, []byte(apiSecret))
+	return ParseValues(form, apiSecret)
+}
 
-	if err = r.ParseForm(); err != nil {
-		return
+// Parse the form values of a callback request.
+// The mac is verified before any field is parsed, so the message is only returned if it is authentic.
+func ParseValues(form url.Values, apiSecret string) (*EncryptedMessage, error) {
+	if err := VerifyMac(form, apiSecret); err != nil {
+		return nil, err
 	}
+	return parseFields(form)
+}
+
+// Parse the callback fields without verifying the mac
+func parseFields(form url.Values) (message *EncryptedMessage, err error) {
 	message = new(EncryptedMessage)
-	{
-		message.From, err = getStringWithFixedLength(r.Form, "from", fromStringLength)
-		calculatedMac.Write([]byte(message.From))
-		if err != nil {
-			return
-		}
+	if message.From, err = getStringWithFixedLength(form, "from", fromStringLength); err != nil {
+		return nil, err
 	}
-	{
-		message.To, err = getStringWithFixedLength(r.Form, "to", toStringLength)
-		if err != nil {
-			return
-		}
-		calculatedMac.Write([]byte(message.To))
+	if message.To, err = getStringWithFixedLength(form, "to", toStringLength); err != nil {
+		return nil, err
 	}
 	{
 		var rawMessageID string
-		rawMessageID, err = getStringWithFixedLength(r.Form, "messageId", messageIDByteLength*2)
+		rawMessageID, err = getStringWithFixedLength(form, "messageId", messageIDByteLength*2)
 		if err != nil {
-			return
+			return nil, err
 		}
-		calculatedMac.Write([]byte(rawMessageID))
-		message.MessageID, err  = gateway.ReadMessageIDFromHex(rawMessageID)
+		message.MessageID, err = gateway.ReadMessageIDFromHex(rawMessageID)
 		if err != nil {
-			err = fmt.Errorf("failed to read message id: %s", err)
-			return
+			return nil, invalidField("messageId", "failed to read message id: %s", err)
 		}
 	}
-	{
-		rawDate := r.Form.Get("date")
-		calculatedMac.Write([]byte(rawDate))
-		message.Date, err = parseDateString(rawDate)
-		if err != nil {
-			return
-		}
+	if message.Date, err = parseDateString(form.Get("date")); err != nil {
+		return nil, err
 	}
-	{
-		rawNonce := r.Form.Get("nonce")
-		message.Nonce, err = gateway.ReadHexNonce(rawNonce)
-		if err != nil {
-			return
-		}
-		calculatedMac.Write([]byte(rawNonce))
+	if message.Nonce, err = gateway.ReadHexNonce(form.Get("nonce")); err != nil {
+		return nil, invalidField("nonce", "%s", err)
 	}
-
-
-	rawBox := r.Form.Get("box")
-	calculatedMac.Write([]byte(rawBox))
-
-
-	// nick name is not included in the mac, so it could be forged
-	message.Nickname = r.Form.Get("nickname")
-	if len(message.Nickname) > 32 {
-		message.Nickname = message.Nickname[:32]
+	if message.Box, err = parseBox(form.Get("box")); err != nil {
+		return nil, err
 	}
-
-	{
-		var mac []byte
-		mac, err = parseMac(r.Form.Get("mac"))
-		if err != nil {
-			return
-		}
-		if !hmac.Equal(calculatedMac.Sum(nil), mac) {
-			err = errors.New("mac does not match")
-		}
+	if message.Mac, err = parseMac(form.Get("mac")); err != nil {
+		return nil, err
 	}
 
-
-	// Box is only decoded after mac verification, because it has a various length
-	message.Box, err = hex.DecodeString(rawBox)
-	return
+	// nick name is not included in the mac, so it could be forged
+	message.Nickname = form.Get("nickname")
+	if len(message.Nickname) > nicknameMaxLength {
+		message.Nickname = message.Nickname[:nicknameMaxLength]
+	}
+	return message, nil
 }
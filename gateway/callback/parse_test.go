@@ -0,0 +1,154 @@
+package callback
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "apisecret"
+
+// The mac is HMAC-SHA256 over from, to, messageId, date, nonce and box (as transmitted, hex encoded)
+// with the API secret, in the order of the callback section of the Threema Gateway API documentation.
+// It was calculated independently with Python's hmac module:
+//
+//	hmac.new(b"apisecret", b"ECHOECHO*TESTTST00112233445566771600000000" + b"ab"*24 + b"cafe", hashlib.sha256).hexdigest()
+func testValues() url.Values {
+	return url.Values{
+		"from":      {"ECHOECHO"},
+		"to":        {"*TESTTST"},
+		"messageId": {"0011223344556677"},
+		"date":      {"1600000000"},
+		"nonce":     {strings.Repeat("ab", 24)},
+		"box":       {"cafe"},
+		"mac":       {"0e7f6c15c75b52f3b16841008db3f7b019fd8f7b99be0a5d9f2bed6a0973c0c6"},
+		"nickname":  {"Echo"},
+	}
+}
+
+func newTestRequest(values url.Values) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(values.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestReadMessage(t *testing.T) {
+	message, err := ReadMessage(newTestRequest(testValues()), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.From != "ECHOECHO" || message.To != "*TESTTST" || message.Nickname != "Echo" {
+		t.Errorf("unexpected message %+v", message)
+	}
+	if message.MessageID[0] != 0x00 || message.MessageID[7] != 0x77 {
+		t.Errorf("unexpected message id %x", message.MessageID[:])
+	}
+	if !message.Date.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("unexpected date %s", message.Date)
+	}
+	if string(message.Box) != "\xca\xfe" {
+		t.Errorf("unexpected box %x", message.Box)
+	}
+}
+
+func TestReadMessageInvalidMac(t *testing.T) {
+	// Changing any authenticated field must invalidate the mac
+	for _, field := range macFields {
+		t.Run(field, func(t *testing.T) {
+			values := testValues()
+			value := []byte(values.Get(field))
+			if value[0] == 'a' {
+				value[0] = 'b'
+			} else {
+				value[0] = 'a'
+			}
+			values.Set(field, string(value))
+			message, err := ReadMessage(newTestRequest(values), testSecret)
+			if !errors.Is(err, ErrInvalidMAC) {
+				t.Errorf("expected ErrInvalidMAC, got %v", err)
+			}
+			if message != nil {
+				t.Error("message returned with invalid mac")
+			}
+		})
+	}
+	t.Run("wrong secret", func(t *testing.T) {
+		if _, err := ReadMessage(newTestRequest(testValues()), "other"); !errors.Is(err, ErrInvalidMAC) {
+			t.Errorf("expected ErrInvalidMAC, got %v", err)
+		}
+	})
+	t.Run("nickname is not authenticated", func(t *testing.T) {
+		values := testValues()
+		values.Set("nickname", "Forged")
+		if _, err := ReadMessage(newTestRequest(values), testSecret); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestReadMessageValidation(t *testing.T) {
+	var validationError *ValidationError
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		check   func(error) bool
+	}{
+		{"get request", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/callback?"+testValues().Encode(), nil)
+		}, func(err error) bool { return errors.Is(err, ErrMethodNotAllowed) }},
+		{"fields in query", func() *http.Request {
+			request := newTestRequest(testValues())
+			request.URL.RawQuery = "from=ECHOECHO"
+			return request
+		}, func(err error) bool { return errors.As(err, &validationError) && validationError.Field == "from" }},
+		{"body too large", func() *http.Request {
+			values := testValues()
+			values.Set("box", strings.Repeat("00", MaxRequestBodyBytes))
+			return newTestRequest(values)
+		}, func(err error) bool { return errors.Is(err, ErrRequestTooLarge) }},
+		{"wrong content type", func() *http.Request {
+			request := newTestRequest(testValues())
+			request.Header.Set("Content-Type", "text/plain")
+			return request
+		}, func(err error) bool { return errors.As(err, &validationError) }},
+		{"missing mac", func() *http.Request {
+			values := testValues()
+			values.Del("mac")
+			return newTestRequest(values)
+		}, func(err error) bool { return errors.As(err, &validationError) && validationError.Field == "mac" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := ReadMessage(test.request(), testSecret)
+			if !test.check(err) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if message != nil {
+				t.Error("message returned for invalid request")
+			}
+		})
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	message, err := ReadMessage(newTestRequest(testValues()), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := Sign(message, testSecret)
+	if signed.Encode() != testValues().Encode() {
+		t.Errorf("got %s, expected %s", signed.Encode(), testValues().Encode())
+	}
+
+	request, err := NewRequest("http://localhost/callback", message, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadMessage(request, testSecret); err != nil {
+		t.Errorf("signed request is invalid: %v", err)
+	}
+}
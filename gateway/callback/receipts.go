@@ -0,0 +1,93 @@
+package callback
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+)
+
+const (
+	// The default delay in which receipts to the same sender are combined
+	DefaultReceiptDelay = time.Second
+	// The maximum number of message IDs in one delivery receipt
+	maxReceiptMessageIDs = 256
+)
+
+type receiptKey struct {
+	recipientID  string
+	deliveryType gateway.DeliveryReceiptType
+}
+
+// receiptBatcher combines delivery receipts for the same recipient and type,
+// so a single receipt is sent for multiple messages.
+type receiptBatcher struct {
+	client *gateway.EncryptedClient
+	delay  time.Duration
+	logf   func(format string, v ...interface{})
+
+	mutex   sync.Mutex
+	pending map[receiptKey][]*gateway.MessageID
+	timers  map[receiptKey]*time.Timer
+	sending sync.WaitGroup
+}
+
+func newReceiptBatcher(client *gateway.EncryptedClient, delay time.Duration, logf func(string, ...interface{})) *receiptBatcher {
+	return &receiptBatcher{
+		client:  client,
+		delay:   delay,
+		logf:    logf,
+		pending: make(map[receiptKey][]*gateway.MessageID),
+		timers:  make(map[receiptKey]*time.Timer),
+	}
+}
+
+// Queue a receipt for the message. It is sent after the delay together with
+// all other receipts of the same type for the recipient.
+func (b *receiptBatcher) add(recipientID string, deliveryType gateway.DeliveryReceiptType, messageID *gateway.MessageID) {
+	key := receiptKey{recipientID: recipientID, deliveryType: deliveryType}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pending[key] = append(b.pending[key], messageID)
+	if len(b.pending[key]) >= maxReceiptMessageIDs {
+		b.flushLocked(key)
+		return
+	}
+	if _, ok := b.timers[key]; !ok {
+		b.timers[key] = time.AfterFunc(b.delay, func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			b.flushLocked(key)
+		})
+	}
+}
+
+// Send the pending receipts for the key. The mutex must be held.
+func (b *receiptBatcher) flushLocked(key receiptKey) {
+	if timer, ok := b.timers[key]; ok {
+		timer.Stop()
+		delete(b.timers, key)
+	}
+	messageIDs := b.pending[key]
+	delete(b.pending, key)
+	if len(messageIDs) == 0 {
+		return
+	}
+	b.sending.Add(1)
+	go func() {
+		defer b.sending.Done()
+		if _, err := b.client.SendDeliveryReceipt(key.recipientID, key.deliveryType, messageIDs...); err != nil {
+			b.logf("failed to send delivery receipt to %s: %s", key.recipientID, err)
+		}
+	}()
+}
+
+// Send all pending receipts and wait until they are sent.
+func (b *receiptBatcher) flush() {
+	b.mutex.Lock()
+	for key := range b.pending {
+		b.flushLocked(key)
+	}
+	b.mutex.Unlock()
+	b.sending.Wait()
+}
@@ -0,0 +1,46 @@
+package callback
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Create the form values of a callback request for the message, as they are sent by the gateway.
+// The mac is calculated with the API secret, the Mac field of the message is ignored.
+func Sign(message *EncryptedMessage, apiSecret string) url.Values {
+	values := formValues(message)
+	values.Set("mac", hex.EncodeToString(calculateMac(values, apiSecret)))
+	return values
+}
+
+// Encode the message as callback form values, using the Mac field of the message
+func formValues(message *EncryptedMessage) url.Values {
+	values := url.Values{
+		"from":      {message.From},
+		"to":        {message.To},
+		"messageId": {hex.EncodeToString(message.MessageID[:])},
+		"date":      {strconv.FormatInt(message.Date.Unix(), 10)},
+		"nonce":     {hex.EncodeToString(message.Nonce[:])},
+		"box":       {hex.EncodeToString(message.Box)},
+		"mac":       {hex.EncodeToString(message.Mac)},
+	}
+	if message.Nickname != "" {
+		values.Set("nickname", message.Nickname)
+	}
+	return values
+}
+
+// Create a callback request to the URL for the message with a valid mac.
+// This allows to test a callback handler without the gateway.
+func NewRequest(callbackURL string, message *EncryptedMessage, apiSecret string) (*http.Request, error) {
+	body := Sign(message, apiSecret).Encode()
+	request, err := http.NewRequest(http.MethodPost, callbackURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
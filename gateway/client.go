@@ -14,10 +14,15 @@ import (
 	"strings"
 )
 
+// The URL of the Threema Gateway API
+const DefaultBaseURL = "https://msgapi.threema.ch"
+
 type Client struct {
 	Secret string
 	ID     string
 	Client *http.Client
+	// The URL of the API. If empty, DefaultBaseURL is used.
+	BaseURL string
 }
 
 func (c *Client) client() *http.Client {
@@ -27,6 +32,13 @@ func (c *Client) client() *http.Client {
 	return http.DefaultClient
 }
 
+func (c *Client) baseURL() string {
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/")
+	}
+	return DefaultBaseURL
+}
+
 var (
 	ErrIDNotFound          = errors.New("threema identity not found")
 	ErrBlobNotFound        = errors.New("blob not found")
@@ -45,7 +57,8 @@ func (c *Client) LookupPublicKey(threemaID string) (pk *PublicKey, err error) {
 	if err = checkIdentity(threemaID); err != nil {
 		return
 	}
-	response, err := c.client().Get(fmt.Sprintf("https://msgapi.threema.ch/pubkeys/%s?from=%s&secret=%s",
+	response, err := c.client().Get(fmt.Sprintf("%s/pubkeys/%s?from=%s&secret=%s",
+		c.baseURL(),
 		url.PathEscape(threemaID), url.QueryEscape(c.ID), url.QueryEscape(c.Secret)))
 	if err != nil {
 		return nil, err
@@ -76,7 +89,7 @@ func (c *Client) LookupPublicKey(threemaID string) (pk *PublicKey, err error) {
 // Send the message and returns the message ID
 func (c *Client) SendEncryptedMessage(to string, box *EncryptedMessage) (messageId string, err error) {
 	var resp *http.Response
-	resp, err = c.client().PostForm("https://msgapi.threema.ch/send_e2e",
+	resp, err = c.client().PostForm(c.baseURL()+"/send_e2e",
 		url.Values{"from": {c.ID},
 			"to":     {to},
 			"nonce":  {hex.EncodeToString((*box.Nonce)[:])},
@@ -172,7 +185,8 @@ func (c *Client) UploadBlob(blob []byte) (blobID *BlobID, err error) {
 		return
 	}
 	//contentType, requestBody := transformToMultipart(blobBody)
-	request, err := http.NewRequest("POST", fmt.Sprintf("https://msgapi.threema.ch/upload_blob?secret=%s&from=%s",
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s/upload_blob?secret=%s&from=%s",
+		c.baseURL(),
 		url.QueryEscape(c.Secret),
 		url.QueryEscape(c.ID)), body)
 	if err != nil {
@@ -210,7 +224,8 @@ func (c *Client) UploadBlob(blob []byte) (blobID *BlobID, err error) {
 }
 
 func (c *Client) DownloadBlob(blobID *BlobID) ([]byte, error) {
-	resp, err := c.client().Get(fmt.Sprintf("https://msgapi.threema.ch/blobs/%s?from=%s&secret=%s",
+	resp, err := c.client().Get(fmt.Sprintf("%s/blobs/%s?from=%s&secret=%s",
+		c.baseURL(),
 		hex.EncodeToString(blobID[:]),
 		url.QueryEscape(c.ID),
 		url.QueryEscape(c.Secret)))
@@ -232,6 +247,8 @@ func (c *Client) DownloadBlob(blobID *BlobID) ([]byte, error) {
 		err = ErrBlobNotFound
 	case http.StatusInternalServerError:
 		err = ErrInternalServerError
+	default:
+		err = ErrRequestFailed
 	}
 	return nil, err
 }
@@ -0,0 +1,295 @@
+/*
+Package dialog models multi-step conversations with the sender of a message.
+
+A Flow consists of named steps. Each text message of a sender with an active session
+is passed to the current step, which decides the next step. Sessions expire after a timeout.
+
+The manager is used in front of other handlers, for example a bot:
+
+	handler.Handle(gateway.TypeText, manager.Handler(b.HandleMessage))
+*/
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+// The default time after which an inactive session expires
+const DefaultTimeout = 10 * time.Minute
+
+// Returned by a StepFunc to end the session
+const End = ""
+
+var ErrUnknownFlow = errors.New("unknown dialog flow")
+
+// A StepFunc handles a message of the sender in a step of the flow.
+// It returns the name of the next step or End to finish the session.
+type StepFunc func(ctx *Context) (next string, err error)
+
+// A Flow is a dialog consisting of steps
+type Flow struct {
+	// The step that handles the first message after the flow was started
+	Start string
+	// The steps by name
+	Steps map[string]StepFunc
+	// Called when the session expired. Optional.
+	OnTimeout func(ctx *Context) error
+}
+
+// The Session is the state of an active dialog with a sender
+type Session struct {
+	SenderID string            `json:"senderId"`
+	Flow     string            `json:"flow"`
+	Step     string            `json:"step"`
+	Values   map[string]string `json:"values"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// A Store persists the sessions by the identity of the sender
+type Store interface {
+	// Load returns the session of the sender or nil if there is none
+	Load(senderID string) (*Session, error)
+	Save(session *Session) error
+	Delete(senderID string) error
+}
+
+// The Manager dispatches text messages of senders with an active session to the current step of their flow.
+type Manager struct {
+	Client *gateway.EncryptedClient
+
+	// The store of the sessions. If nil, the sessions are kept in memory.
+	Store Store
+
+	// The time after which an inactive session expires. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	mutex    sync.RWMutex
+	flows    map[string]*Flow
+	initOnce sync.Once
+
+	locksMutex sync.Mutex
+	locks      map[string]*senderLock
+}
+
+// The senderLock serializes the messages of a sender
+type senderLock struct {
+	sync.Mutex
+	// The number of messages holding or waiting for the lock
+	users int
+}
+
+// Create a manager that replies with the client and keeps the sessions in memory.
+func NewManager(client *gateway.EncryptedClient) *Manager {
+	return &Manager{
+		Client: client,
+	}
+}
+
+func (m *Manager) store() Store {
+	m.initOnce.Do(func() {
+		if m.Store == nil {
+			m.Store = NewMemoryStore()
+		}
+	})
+	return m.Store
+}
+
+// Lock the session of the sender and return the function to unlock it
+func (m *Manager) lockSender(senderID string) (unlock func()) {
+	m.locksMutex.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*senderLock)
+	}
+	lock, ok := m.locks[senderID]
+	if !ok {
+		lock = new(senderLock)
+		m.locks[senderID] = lock
+	}
+	lock.users++
+	m.locksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		m.locksMutex.Lock()
+		defer m.locksMutex.Unlock()
+		if lock.users--; lock.users == 0 {
+			delete(m.locks, senderID)
+		}
+	}
+}
+
+func (m *Manager) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Register the flow by name
+func (m *Manager) Register(name string, flow *Flow) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.flows == nil {
+		m.flows = make(map[string]*Flow)
+	}
+	m.flows[name] = flow
+}
+
+func (m *Manager) flow(name string) *Flow {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.flows[name]
+}
+
+// Start the flow for the sender. An active session of the sender is replaced.
+// The next text message of the sender is passed to the start step of the flow.
+func (m *Manager) Start(senderID string, flowName string) error {
+	flow := m.flow(flowName)
+	if flow == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownFlow, flowName)
+	}
+	return m.store().Save(&Session{
+		SenderID: senderID,
+		Flow:     flowName,
+		Step:     flow.Start,
+		Values:   make(map[string]string),
+		Expires:  time.Now().Add(m.timeout()),
+	})
+}
+
+// End the session of the sender
+func (m *Manager) Cancel(senderID string) error {
+	return m.store().Delete(senderID)
+}
+
+// Returns the active session of the sender or nil
+func (m *Manager) Session(senderID string) (*Session, error) {
+	session, err := m.store().Load(senderID)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expires) {
+		return nil, nil
+	}
+	return session, nil
+}
+
+// Pass the message to the session of the sender.
+// Returns false if the sender has no active session or the message is not a text message.
+// The messages of a sender are handled one after the other.
+func (m *Manager) HandleMessage(message *callback.DecryptedMessage) (handled bool, err error) {
+	textMessage, ok := message.Message.(*gateway.TextMessage)
+	if !ok {
+		return false, nil
+	}
+	defer m.lockSender(message.From)()
+	session, err := m.store().Load(message.From)
+	if err != nil || session == nil {
+		return false, err
+	}
+	ctx := &Context{
+		Manager: m,
+		Message: message,
+		Text:    string(textMessage.Content),
+		Session: session,
+	}
+	flow := m.flow(session.Flow)
+	if flow == nil {
+		return false, m.store().Delete(session.SenderID)
+	}
+	if time.Now().After(session.Expires) {
+		if err = m.store().Delete(session.SenderID); err != nil {
+			return false, err
+		}
+		if flow.OnTimeout != nil {
+			if err = flow.OnTimeout(ctx); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	step, ok := flow.Steps[session.Step]
+	if !ok {
+		return false, m.store().Delete(session.SenderID)
+	}
+
+	loaded := *session
+	next, err := step(ctx)
+	if err != nil {
+		return true, err
+	}
+	if next == End {
+		return true, m.store().Delete(session.SenderID)
+	}
+	// The step may have canceled the session or (re)started a flow, which replaced the stored session
+	if current, loadErr := m.store().Load(session.SenderID); loadErr != nil || current == nil || !sameState(current, &loaded) {
+		return true, loadErr
+	}
+	session.Step = next
+	session.Expires = time.Now().Add(m.timeout())
+	return true, m.store().Save(session)
+}
+
+// Returns true if both sessions are in the same step of the same flow and expire at the same time
+func sameState(a *Session, b *Session) bool {
+	return a.Flow == b.Flow && a.Step == b.Step && a.Expires.Equal(b.Expires)
+}
+
+// Wrap a callback.MessageHandlerFunc so messages of senders with an active session
+// are handled by the manager and all other messages by next.
+func (m *Manager) Handler(next callback.MessageHandlerFunc) callback.MessageHandlerFunc {
+	return func(message *callback.DecryptedMessage) error {
+		handled, err := m.HandleMessage(message)
+		if err != nil || handled {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		return next(message)
+	}
+}
+
+// The Context of a message in a dialog
+type Context struct {
+	Manager *Manager
+	// The received message
+	Message *callback.DecryptedMessage
+	// The text of the message
+	Text string
+	// The session of the sender. Values stored in the session are persisted after the step.
+	Session *Session
+}
+
+// Returns the identity of the sender
+func (c *Context) Sender() string {
+	return c.Message.From
+}
+
+// Send a text message to the sender
+func (c *Context) Reply(text string) error {
+	_, err := c.Manager.Client.SendTextMessage(c.Sender(), text)
+	return err
+}
+
+// Send a formatted text message to the sender
+func (c *Context) Replyf(format string, args ...interface{}) error {
+	return c.Reply(fmt.Sprintf(format, args...))
+}
+
+// Store a value in the session
+func (c *Context) Set(key string, value string) {
+	c.Session.Values[key] = value
+}
+
+// Returns a value stored in the session
+func (c *Context) Get(key string) string {
+	return c.Session.Values[key]
+}
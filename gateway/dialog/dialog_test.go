@@ -0,0 +1,91 @@
+package dialog_test
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"github.com/coffeemakr/threema/gateway/dialog"
+)
+
+func textMessage(from string, text string) *callback.DecryptedMessage {
+	return &callback.DecryptedMessage{
+		EncryptedMessage: &callback.EncryptedMessage{
+			From:      from,
+			To:        "*TESTTST",
+			MessageID: new(gateway.MessageID),
+		},
+		Message: &gateway.TextMessage{Content: []byte(text)},
+	}
+}
+
+func TestManagerRestart(t *testing.T) {
+	manager := dialog.NewManager(nil)
+	var steps []string
+	manager.Register("order", &dialog.Flow{
+		Start: "item",
+		Steps: map[string]dialog.StepFunc{
+			"item": func(ctx *dialog.Context) (string, error) {
+				steps = append(steps, "item")
+				return "amount", nil
+			},
+			"amount": func(ctx *dialog.Context) (string, error) {
+				steps = append(steps, "amount")
+				if ctx.Text == "restart" {
+					return "confirm", ctx.Manager.Start(ctx.Sender(), "order")
+				}
+				return "confirm", nil
+			},
+		},
+	})
+	if err := manager.Start("ECHOECHO", "order"); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"coffee", "restart", "tea"} {
+		if handled, err := manager.HandleMessage(textMessage("ECHOECHO", text)); err != nil || !handled {
+			t.Fatalf("message %q: handled %t, error %v", text, handled, err)
+		}
+	}
+	if joined := strings.Join(steps, ","); joined != "item,amount,item" {
+		t.Errorf("unexpected steps %s", joined)
+	}
+}
+
+func TestManagerSerializesSender(t *testing.T) {
+	manager := dialog.NewManager(nil)
+	manager.Register("count", &dialog.Flow{
+		Start: "count",
+		Steps: map[string]dialog.StepFunc{
+			"count": func(ctx *dialog.Context) (string, error) {
+				count, _ := strconv.Atoi(ctx.Get("count"))
+				ctx.Set("count", strconv.Itoa(count+1))
+				return "count", nil
+			},
+		},
+	})
+	if err := manager.Start("ECHOECHO", "count"); err != nil {
+		t.Fatal(err)
+	}
+	const messages = 50
+	var wait sync.WaitGroup
+	for i := 0; i < messages; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := manager.HandleMessage(textMessage("ECHOECHO", "+1")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	session, err := manager.Session("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := session.Values["count"]; count != strconv.Itoa(messages) {
+		t.Errorf("count is %s after %d messages", count, messages)
+	}
+}
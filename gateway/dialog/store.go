@@ -0,0 +1,58 @@
+package dialog
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mutex    sync.Mutex
+	sessions map[string]Session
+}
+
+// Create a Store that keeps the sessions in memory
+func NewMemoryStore() Store {
+	return &memoryStore{
+		sessions: make(map[string]Session),
+	}
+}
+
+func (s *memoryStore) Load(senderID string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[senderID]
+	if !ok {
+		return nil, nil
+	}
+	return copySession(&session), nil
+}
+
+func (s *memoryStore) Save(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Drop expired sessions of senders that never came back
+	now := time.Now()
+	for senderID, existing := range s.sessions {
+		if now.After(existing.Expires) {
+			delete(s.sessions, senderID)
+		}
+	}
+	s.sessions[session.SenderID] = *copySession(session)
+	return nil
+}
+
+func (s *memoryStore) Delete(senderID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, senderID)
+	return nil
+}
+
+func copySession(session *Session) *Session {
+	result := *session
+	result.Values = make(map[string]string, len(session.Values))
+	for key, value := range session.Values {
+		result.Values[key] = value
+	}
+	return &result
+}
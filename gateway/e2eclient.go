@@ -6,12 +6,18 @@ import (
 	"mime"
 	"os"
 	"path"
+	"sync"
 )
 
 type EncryptedClient struct {
 	Client           *Client
 	EncryptionHelper EncryptionHelper
 	PublicKeyStore   PublicKeyStore
+	// The source of the keys of uploaded files. If nil, crypto/rand is used.
+	// The randomness of nonces and padding is configured in the EncryptionHelper.
+	Rand io.Reader
+
+	keystoreMutex sync.Mutex
 }
 
 type nopKeyStore struct {}
@@ -28,6 +34,8 @@ func NewNOPKeyStore() PublicKeyStore {
 }
 
 func (c *EncryptedClient) keystore() PublicKeyStore  {
+	c.keystoreMutex.Lock()
+	defer c.keystoreMutex.Unlock()
 	if c.PublicKeyStore == nil {
 		c.PublicKeyStore = NewInMemoryStore()
 	}
@@ -52,10 +60,33 @@ func NewEncryptedClient(threemaId string, apiSecret string, secretKeyHex string)
 	}, nil
 }
 
+// Create a new EncryptedClient that uses the KeyProvider instead of a plain secret key
+func NewKeyProviderEncryptedClient(threemaId string, apiSecret string, keys KeyProvider) (*EncryptedClient, error) {
+	err := checkIdentity(threemaId)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedClient{
+		Client: &Client{
+			Secret: apiSecret,
+			ID:     threemaId,
+		},
+		EncryptionHelper: NewKeyProviderEncryptionHelper(keys),
+	}, nil
+}
+
 func (c *EncryptedClient) SendTextMessage(recipientID string, message string) (messageId string, err error) {
 	return c.SendMessage(recipientID, &TextMessage{[]byte(message)})
 }
 
+// Send a delivery receipt for the messages to the recipient
+func (c *EncryptedClient) SendDeliveryReceipt(recipientID string, deliveryType DeliveryReceiptType, messageIDs ...*MessageID) (messageId string, err error) {
+	return c.SendMessage(recipientID, &DeliveryReceiptMessage{
+		DeliveryType: deliveryType,
+		MessageIDs:   messageIDs,
+	})
+}
+
 type BlobReference struct {
 	BlobID *BlobID
 	Size   uint32
@@ -158,18 +189,52 @@ type PublicKeyStore interface {
 	SavePublicKey(threemaID string, publicKey *PublicKey) error
 }
 
-type inMemoryStore map[string]*PublicKey
+type inMemoryStore struct {
+	mutex    sync.RWMutex
+	keys     map[string]*PublicKey
+	verified map[string]bool
+}
 
-func (s inMemoryStore) FetchPublicKey(threemaID string) (pk *PublicKey) {
-	return s[threemaID]
+func (s *inMemoryStore) FetchPublicKey(threemaID string) (pk *PublicKey) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys[threemaID]
 }
-func (s inMemoryStore) SavePublicKey(threemaID string, publicKey *PublicKey) error {
-	s[threemaID] = publicKey
+func (s *inMemoryStore) SavePublicKey(threemaID string, publicKey *PublicKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if existing := s.keys[threemaID]; existing == nil || *existing != *publicKey {
+		delete(s.verified, threemaID)
+	}
+	s.keys[threemaID] = publicKey
 	return nil
 }
+func (s *inMemoryStore) MarkVerified(threemaID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.keys[threemaID] == nil {
+		return ErrIDNotFound
+	}
+	s.verified[threemaID] = true
+	return nil
+}
+func (s *inMemoryStore) IsVerified(threemaID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.verified[threemaID]
+}
 
+// Create a new PublicKeyStore that keeps the keys and their verification state in memory
 func NewInMemoryStore() PublicKeyStore {
-	return inMemoryStore(make(map[string]*PublicKey))
+	return &inMemoryStore{
+		keys:     make(map[string]*PublicKey),
+		verified: make(map[string]bool),
+	}
+}
+
+// Verify the public key of a contact with a scanned identity code and store it in the key store.
+func (c *EncryptedClient) VerifyIdentityCode(code *IdentityCode) error {
+	return VerifyIdentityCode(c.keystore(), code)
 }
 
 type File interface {
@@ -205,13 +270,20 @@ func (s FilePath) HasThumbnail() bool {
 	return s.ThumbnailPath != ""
 }
 
+func (c *EncryptedClient) randomSecretKey() (*SharedKey, error) {
+	if c.Rand != nil {
+		return RandomSecretKeyFrom(c.Rand)
+	}
+	return RandomSecretKey()
+}
+
 func (c *EncryptedClient) PrepareFile(file File) (msg *FileMessage, err error) {
 	var reader io.ReadCloser
 	var blob *BlobReference
 	var thumbnailBlodID *BlobID
 	var sharedKey *SharedKey
 
-	if sharedKey, err = RandomSecretKey(); err != nil {
+	if sharedKey, err = c.randomSecretKey(); err != nil {
 		return
 	}
 
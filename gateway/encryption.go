@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"golang.org/x/crypto/nacl/box"
+	"io"
 )
 
 const (
@@ -14,7 +15,8 @@ const (
 )
 
 
-var errWrongIdentityLength = errors.New("wrong identity length")
+// Returned if a Threema ID doesn't have 8 characters
+var ErrWrongIdentityLength = errors.New("wrong identity length")
 var errWrongNonceLength = errors.New("wrong identity length")
 var errWrongSecretKeyLength = errors.New("wrong identity length")
 var errWrongPublicKeyLength = errors.New("wrong identity length")
@@ -30,7 +32,7 @@ type Nonce = [cryptoBoxNonceBytes]byte
 
 func checkIdentity(value string) error {
 	if len(value) != 8 {
-		return errWrongIdentityLength
+		return ErrWrongIdentityLength
 	}
 	return nil
 }
@@ -45,14 +47,41 @@ type EncryptionHelper interface {
 }
 
 type encryptionHelper struct {
-	secretKey *SecretKey
+	keys            KeyProvider
+	cache           *sharedKeyCache
+	random          io.Reader
+	minPaddedLength int
+}
+
+// Returns a copy of the key shared with the peer, from the cache if possible. The caller wipes it after use.
+func (e encryptionHelper) sharedKey(publicKey *PublicKey) (*SharedKey, error) {
+	if destroyable, ok := e.keys.(destroyableKeyProvider); ok && destroyable.Destroyed() {
+		if e.cache != nil {
+			e.cache.purge()
+		}
+		return nil, ErrKeyDestroyed
+	}
+	sharedKey := new(SharedKey)
+	if e.cache != nil && e.cache.get(publicKey, sharedKey) {
+		return sharedKey, nil
+	}
+	sharedKey, err := e.keys.SharedKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if e.cache != nil {
+		e.cache.put(publicKey, sharedKey)
+	}
+	return sharedKey, nil
 }
 
 func (e encryptionHelper) EncryptBytesWithNonce(content []byte, publicKey *PublicKey, nonce *Nonce)  (message *EncryptedMessage, err error) {
-	var boxBytes []byte
-	if boxBytes, err = encrypt(content, nonce, publicKey, e.secretKey); err != nil {
+	var sharedKey *SharedKey
+	if sharedKey, err = e.sharedKey(publicKey); err != nil {
 		return nil, err
 	}
+	defer wipe(sharedKey[:])
+	boxBytes := box.SealAfterPrecomputation(nil, content, nonce, sharedKey)
 
 	return &EncryptedMessage{
 		Nonce: nonce,
@@ -62,14 +91,19 @@ func (e encryptionHelper) EncryptBytesWithNonce(content []byte, publicKey *Publi
 
 func (e encryptionHelper) EncryptBytes(content []byte, publicKey *PublicKey) (message *EncryptedMessage, err error) {
 	var nonce *Nonce
-	if nonce, err = CreateNonce(); err != nil {
+	if nonce, err = CreateNonceFrom(e.random); err != nil {
 		return nil, err
 	}
 	return e.EncryptBytesWithNonce(content, publicKey, nonce)
 }
 
 func (e encryptionHelper) DecryptBytes(content []byte,  publicKey *PublicKey, nonce *Nonce) ([]byte, error) {
-	result, ok := box.Open(nil, content, nonce, publicKey, e.secretKey)
+	sharedKey, err := e.sharedKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(sharedKey[:])
+	result, ok := box.OpenAfterPrecomputation(nil, content, nonce, sharedKey)
 	if !ok {
 		return nil, errors.New("invalid box")
 	}
@@ -84,20 +118,69 @@ func (e encryptionHelper) DecryptMessage(cipher []byte,  publicKey *PublicKey, n
 	return ReadMessage(plaintext)
 }
 
+// Create an EncryptionHelper from the hex encoded secret key
 func NewEncryptionHelper(secret string) (EncryptionHelper, error) {
 	secretKey, err := ReadHexSecretKey(secret)
 	if err != nil {
 		return nil, err
 	}
-	return &encryptionHelper{
-		secretKey: secretKey,
-	}, nil
+	return NewKeyProviderEncryptionHelper(NewSecretKeyProvider(secretKey)), nil
 }
 
-func encrypt(m []byte, n *Nonce, pk *PublicKey, sk *SecretKey) (c []byte, err error) {
-	var result []byte
-	result = box.Seal(result, m, n, pk, sk)
-	return result, nil
+// Create an EncryptionHelper that uses the KeyProvider for all operations with the secret key.
+// Up to DefaultSharedKeyCacheSize shared keys are cached.
+func NewKeyProviderEncryptionHelper(keys KeyProvider) EncryptionHelper {
+	return NewCachingEncryptionHelper(keys, DefaultSharedKeyCacheSize)
+}
+
+// Create an EncryptionHelper that caches the keys shared with up to cacheSize peers.
+// If cacheSize is zero or negative, the shared key is calculated for every operation.
+func NewCachingEncryptionHelper(keys KeyProvider, cacheSize int) EncryptionHelper {
+	if cacheSize <= 0 {
+		cacheSize = -1
+	}
+	return NewEncryptionHelperWithOptions(keys, EncryptionOptions{SharedKeyCacheSize: cacheSize})
+}
+
+// The EncryptionOptions configure an EncryptionHelper
+type EncryptionOptions struct {
+	// The source of nonces and padding. If nil, crypto/rand is used.
+	// Tests can use a deterministic source to create byte-exact boxes.
+	Rand io.Reader
+
+	// Messages are padded to at least this length.
+	// If zero, MinPaddedLength is used. If negative, only the random padding is added.
+	MinPaddedLength int
+
+	// The number of cached shared keys.
+	// If zero, DefaultSharedKeyCacheSize is used. If negative, no keys are cached.
+	SharedKeyCacheSize int
+}
+
+// Create an EncryptionHelper that uses the KeyProvider for all operations with the secret key
+func NewEncryptionHelperWithOptions(keys KeyProvider, options EncryptionOptions) EncryptionHelper {
+	helper := &encryptionHelper{
+		keys:            keys,
+		random:          options.Rand,
+		minPaddedLength: options.MinPaddedLength,
+	}
+	if helper.random == nil {
+		helper.random = rand.Reader
+	}
+	if helper.minPaddedLength == 0 {
+		helper.minPaddedLength = MinPaddedLength
+	}
+	cacheSize := options.SharedKeyCacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultSharedKeyCacheSize
+	}
+	if cacheSize > 0 {
+		helper.cache = newSharedKeyCache(cacheSize)
+		if destroyable, ok := keys.(destroyableKeyProvider); ok {
+			destroyable.notifyDestroy(helper.cache.purge)
+		}
+	}
+	return helper
 }
 
 func ReadHexSecretKey(hexSecretKey string) (*SecretKey, error) {
@@ -117,8 +200,13 @@ func ReadHexPublicKey(hexPublicKey string) (*PublicKey, error) {
 }
 
 func CreateNonce() (*Nonce, error) {
+	return CreateNonceFrom(rand.Reader)
+}
+
+// Create a nonce with the bytes read from random
+func CreateNonceFrom(random io.Reader) (*Nonce, error) {
 	var nonce [24]byte
-	_, err := rand.Read(nonce[:])
+	_, err := io.ReadFull(random, nonce[:])
 	return &nonce, err
 }
 
@@ -159,6 +247,9 @@ type EncryptedMessage struct {
 }
 
 func (e *encryptionHelper)  EncryptMessage(message Message, publicKey *PublicKey)  (*EncryptedMessage, error) {
-	plaintextBytes := PackMessage(message)
+	plaintextBytes, err := PackMessageWithPadding(message, e.random, e.minPaddedLength)
+	if err != nil {
+		return nil, err
+	}
 	return e.EncryptBytes(plaintextBytes, publicKey)
 }
\ No newline at end of file
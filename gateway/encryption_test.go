@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func filled(value byte, length int) []byte {
+	return bytes.Repeat([]byte{value}, length)
+}
+
+func filledKey(value byte) *[32]byte {
+	key := new([32]byte)
+	copy(key[:], filled(value, 32))
+	return key
+}
+
+func filledNonce(value byte) *Nonce {
+	nonce := new(Nonce)
+	copy(nonce[:], filled(value, cryptoBoxNonceBytes))
+	return nonce
+}
+
+func mustDecodeHex(t *testing.T, value string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// Known answer of TestBox in golang.org/x/crypto/nacl/box, which was generated with the C implementation
+// of NaCl (crypto_box with secret key 0x02..., the public key of secret key 0x01..., nonce 0x04...
+// and a message of 64 times 0x03)
+const naclBoxVector = "78ea30b19d2341ebbdba54180f821eec265cf86312549bea8a37652a8bb94f07b78a73ed1708085e6ddd0e943bbdeb8755079a37eb31d86163ce241164a47629c0539f330b4914cd135b3855bc2a2dfc"
+
+func TestPublicKeyFromSecretKey(t *testing.T) {
+	publicKey := PublicKeyFromSecretKey(filledKey(1))
+	expected := "a4e09292b651c278b9772c569f5fa9bb13d906b46ab68c9df9dc2b4409f8a209"
+	if hex.EncodeToString(publicKey[:]) != expected {
+		t.Errorf("got %x, expected %s", publicKey[:], expected)
+	}
+}
+
+func TestEncryptBytesWithNonce(t *testing.T) {
+	tests := []struct {
+		name     string
+		helper   EncryptionHelper
+		expected string
+	}{
+		{"uncached", NewCachingEncryptionHelper(NewSecretKeyProvider(filledKey(2)), 0), naclBoxVector},
+		{"cached", NewCachingEncryptionHelper(NewSecretKeyProvider(filledKey(2)), 1), naclBoxVector},
+		{"hex", mustEncryptionHelper(t, hex.EncodeToString(filled(2, 32))), naclBoxVector},
+	}
+	publicKey := PublicKeyFromSecretKey(filledKey(1))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Encrypt twice to use the cached shared key
+			for i := 0; i < 2; i++ {
+				encrypted, err := test.helper.EncryptBytesWithNonce(filled(3, 64), publicKey, filledNonce(4))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hex.EncodeToString(encrypted.Box) != test.expected {
+					t.Errorf("got %x, expected %s", encrypted.Box, test.expected)
+				}
+				if *encrypted.Nonce != *filledNonce(4) {
+					t.Errorf("unexpected nonce %x", encrypted.Nonce[:])
+				}
+			}
+		})
+	}
+}
+
+func mustEncryptionHelper(t *testing.T, secretKey string) EncryptionHelper {
+	helper, err := NewEncryptionHelper(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return helper
+}
+
+func TestDecryptBytes(t *testing.T) {
+	helper := NewKeyProviderEncryptionHelper(NewSecretKeyProvider(filledKey(1)))
+	senderPublicKey := PublicKeyFromSecretKey(filledKey(2))
+
+	plaintext, err := helper.DecryptBytes(mustDecodeHex(t, naclBoxVector), senderPublicKey, filledNonce(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, filled(3, 64)) {
+		t.Errorf("got %x", plaintext)
+	}
+
+	if _, err = helper.DecryptBytes(mustDecodeHex(t, naclBoxVector), senderPublicKey, filledNonce(5)); err == nil {
+		t.Error("decryption with wrong nonce succeeded")
+	}
+	tampered := mustDecodeHex(t, naclBoxVector)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = helper.DecryptBytes(tampered, senderPublicKey, filledNonce(4)); err == nil {
+		t.Error("decryption of tampered box succeeded")
+	}
+}
+
+func TestEncryptMessageRoundTrip(t *testing.T) {
+	alice := NewKeyProviderEncryptionHelper(NewSecretKeyProvider(filledKey(1)))
+	bob := NewKeyProviderEncryptionHelper(NewSecretKeyProvider(filledKey(2)))
+
+	encrypted, err := alice.EncryptMessage(&TextMessage{Content: []byte("Hello Bob")}, PublicKeyFromSecretKey(filledKey(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := bob.DecryptMessage(encrypted.Box, PublicKeyFromSecretKey(filledKey(1)), encrypted.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, ok := message.(*TextMessage)
+	if !ok || string(text.Content) != "Hello Bob" {
+		t.Errorf("unexpected message %#v", message)
+	}
+}
+
+func TestEncryptMessageDeterministic(t *testing.T) {
+	encrypt := func() *EncryptedMessage {
+		helper := NewEncryptionHelperWithOptions(NewSecretKeyProvider(filledKey(1)), EncryptionOptions{
+			// The padding length is read first, then the nonce
+			Rand: bytes.NewReader(append([]byte{5}, filled(4, cryptoBoxNonceBytes)...)),
+		})
+		encrypted, err := helper.EncryptMessage(&TextMessage{Content: []byte("Hello Bob")}, PublicKeyFromSecretKey(filledKey(2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encrypted
+	}
+	first, second := encrypt(), encrypt()
+	if !bytes.Equal(first.Box, second.Box) || *first.Nonce != *second.Nonce {
+		t.Error("encryption with the same random source differs")
+	}
+	if *first.Nonce != *filledNonce(4) {
+		t.Errorf("unexpected nonce %x", first.Nonce[:])
+	}
+
+	bob := NewKeyProviderEncryptionHelper(NewSecretKeyProvider(filledKey(2)))
+	plaintext, err := bob.DecryptBytes(first.Box, PublicKeyFromSecretKey(filledKey(1)), first.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 type byte and 9 bytes content are padded to the minimum of 32 bytes
+	expected := append(append([]byte{byte(TypeText)}, "Hello Bob"...), filled(22, 22)...)
+	if !bytes.Equal(plaintext, expected) {
+		t.Errorf("got %x, expected %x", plaintext, expected)
+	}
+}
+
+func TestSecretKeyProviderDestroy(t *testing.T) {
+	secretKey := filledKey(1)
+	provider := NewSecretKeyProvider(secretKey)
+	provider.Destroy()
+	if *secretKey != [32]byte{} {
+		t.Error("secret key was not overwritten")
+	}
+	if _, err := provider.SharedKey(PublicKeyFromSecretKey(filledKey(2))); err != ErrKeyDestroyed {
+		t.Errorf("expected ErrKeyDestroyed, got %v", err)
+	}
+	if _, err := provider.PublicKey(); err != ErrKeyDestroyed {
+		t.Errorf("expected ErrKeyDestroyed, got %v", err)
+	}
+}
+
+func TestEncryptAfterDestroy(t *testing.T) {
+	provider := NewSecretKeyProvider(filledKey(1))
+	helper := NewCachingEncryptionHelper(provider, 1)
+	publicKey := PublicKeyFromSecretKey(filledKey(2))
+	// Fill the cache with the shared key
+	if _, err := helper.EncryptBytes(filled(3, 16), publicKey); err != nil {
+		t.Fatal(err)
+	}
+	provider.Destroy()
+	if _, err := helper.EncryptBytes(filled(3, 16), publicKey); err != ErrKeyDestroyed {
+		t.Errorf("expected ErrKeyDestroyed, got %v", err)
+	}
+	if _, err := helper.DecryptBytes(mustDecodeHex(t, naclBoxVector), publicKey, filledNonce(4)); err != ErrKeyDestroyed {
+		t.Errorf("expected ErrKeyDestroyed, got %v", err)
+	}
+	cache := helper.(*encryptionHelper).cache
+	if cache.order.Len() != 0 || len(cache.entries) != 0 {
+		t.Error("cache was not purged")
+	}
+	// A key computed concurrently with Destroy is not cached afterwards
+	cache.put(publicKey, filledKey(5))
+	if cache.order.Len() != 0 {
+		t.Error("key was cached after the purge")
+	}
+}
+
+func TestSharedKeyCacheEviction(t *testing.T) {
+	cache := newSharedKeyCache(2)
+	for i := byte(1); i <= 3; i++ {
+		cache.put(filledKey(i), filledKey(i+10))
+	}
+	sharedKey := new(SharedKey)
+	if cache.get(filledKey(1), sharedKey) {
+		t.Error("oldest key was not evicted")
+	}
+	if !cache.get(filledKey(3), sharedKey) || *sharedKey != *filledKey(13) {
+		t.Errorf("unexpected cached key %x", sharedKey[:])
+	}
+}
+
+func TestReadHexKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"valid", hex.EncodeToString(filled(1, 32)), false},
+		{"short", hex.EncodeToString(filled(1, 31)), true},
+		{"long", hex.EncodeToString(filled(1, 33)), true},
+		{"not hex", "zz" + hex.EncodeToString(filled(1, 31)), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadHexSecretKey(test.value); (err != nil) != test.wantErr {
+				t.Errorf("ReadHexSecretKey error = %v, wantErr %v", err, test.wantErr)
+			}
+			if _, err := ReadHexPublicKey(test.value); (err != nil) != test.wantErr {
+				t.Errorf("ReadHexPublicKey error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
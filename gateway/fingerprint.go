@@ -0,0 +1,15 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const fingerprintBytes = 16
+
+// Calculate the fingerprint of a public key as displayed by the Threema apps.
+// The fingerprint consists of the first 16 bytes of the SHA-256 hash of the public key, hex encoded.
+func Fingerprint(pk *PublicKey) string {
+	hash := sha256.Sum256(pk[:])
+	return hex.EncodeToString(hash[:fingerprintBytes])
+}
@@ -0,0 +1,21 @@
+package gateway
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicKey *PublicKey
+		expected  string
+	}{
+		{"zero key", new(PublicKey), "66687aadf862bd776c8fc18b8e9f8e20"},
+		{"public key of 0x01...", PublicKeyFromSecretKey(filledKey(1)), "1a92f23852dc908d97316a3b13578281"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if fingerprint := Fingerprint(test.publicKey); fingerprint != test.expected {
+				t.Errorf("got %s, expected %s", fingerprint, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,526 @@
+/*
+Package gatewaytest provides an in-process fake of the Threema Gateway API for tests.
+
+The Server stores all sent messages and uploaded blobs, so tests can decrypt and inspect
+what a client sent. It can also deliver signed callbacks to a callback handler.
+*/
+package gatewaytest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// The default maximum size of uploaded blobs
+const DefaultMaxBlobSize = 50 * 1024 * 1024
+
+// maximum size of a box, like the real gateway
+const maxBoxSize = 4000
+
+// An Identity is a Threema ID with its key pair and the data used for lookups
+type Identity struct {
+	ID        string
+	PublicKey *gateway.PublicKey
+	SecretKey *gateway.SecretKey
+	Phone     string
+	Email     string
+	// The capabilities returned by the capabilities lookup
+	Capabilities []string
+}
+
+// Returns the hex encoded secret key, as accepted by gateway.NewEncryptedClient
+func (i *Identity) SecretKeyHex() string {
+	return hex.EncodeToString(i.SecretKey[:])
+}
+
+// Returns an EncryptionHelper with the secret key of the identity
+func (i *Identity) EncryptionHelper() gateway.EncryptionHelper {
+	secretKey := *i.SecretKey
+	return gateway.NewKeyProviderEncryptionHelper(gateway.NewSecretKeyProvider(&secretKey))
+}
+
+// Create an identity with a random key pair
+func NewIdentity(threemaID string) (*Identity, error) {
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		ID:           threemaID,
+		PublicKey:    publicKey,
+		SecretKey:    secretKey,
+		Capabilities: []string{"text", "image", "video", "audio", "file"},
+	}, nil
+}
+
+// An Account is a gateway ID that can authenticate at the server
+type Account struct {
+	*Identity
+	Secret  string
+	Credits int
+}
+
+// A SentMessage is a message that was sent by an account
+type SentMessage struct {
+	MessageID string
+	From      string
+	To        string
+	// The nonce of end-to-end encrypted messages
+	Nonce *gateway.Nonce
+	// The box of end-to-end encrypted messages
+	Box []byte
+	// The text of messages sent in basic mode
+	Text string
+	Time time.Time
+}
+
+// The Server is a fake of the gateway API. Use URL as BaseURL of gateway.Client
+// or create clients with NewClient and NewEncryptedClient.
+type Server struct {
+	*httptest.Server
+
+	// The maximum size of uploaded blobs. If zero, DefaultMaxBlobSize is used.
+	MaxBlobSize int
+
+	mutex      sync.Mutex
+	accounts   map[string]*Account
+	identities map[string]*Identity
+	sent       []*SentMessage
+	blobs      map[gateway.BlobID][]byte
+	failures   map[string]int
+}
+
+// Create and start a new fake server. Close must be called after the test.
+func NewServer() *Server {
+	s := &Server{
+		accounts:   make(map[string]*Account),
+		identities: make(map[string]*Identity),
+		blobs:      make(map[gateway.BlobID][]byte),
+		failures:   make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pubkeys/", s.handlePublicKey)
+	mux.HandleFunc("/send_e2e", s.handleSendE2E)
+	mux.HandleFunc("/send", s.handleSend)
+	mux.HandleFunc("/upload_blob", s.handleUploadBlob)
+	mux.HandleFunc("/blobs/", s.handleBlob)
+	mux.HandleFunc("/lookup/phone/", s.handleLookup(func(i *Identity) string { return i.Phone }))
+	mux.HandleFunc("/lookup/email/", s.handleLookup(func(i *Identity) string { return strings.ToLower(i.Email) }))
+	mux.HandleFunc("/lookup/phone_hash/", s.handleLookup(func(i *Identity) string { return hashOrEmpty(i.Phone, gateway.HashPhoneNumber) }))
+	mux.HandleFunc("/lookup/email_hash/", s.handleLookup(func(i *Identity) string { return hashOrEmpty(i.Email, gateway.HashEmail) }))
+	mux.HandleFunc("/capabilities/", s.handleCapabilities)
+	mux.HandleFunc("/credits", s.handleCredits)
+	s.Server = httptest.NewServer(s.withFailures(mux))
+	return s
+}
+
+// Register an identity, so its public key can be looked up and messages can be sent to it
+func (s *Server) AddIdentity(identity *Identity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.identities[identity.ID] = identity
+}
+
+// Create and register an identity with a random key pair
+func (s *Server) NewIdentity(threemaID string) (*Identity, error) {
+	identity, err := NewIdentity(threemaID)
+	if err != nil {
+		return nil, err
+	}
+	s.AddIdentity(identity)
+	return identity, nil
+}
+
+// Create and register a gateway account with a random key pair
+func (s *Server) NewAccount(threemaID string, secret string, credits int) (*Account, error) {
+	identity, err := s.NewIdentity(threemaID)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{
+		Identity: identity,
+		Secret:   secret,
+		Credits:  credits,
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accounts[threemaID] = account
+	return account, nil
+}
+
+// Returns the remaining credits of the account
+func (s *Server) Credits(threemaID string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if account, ok := s.accounts[threemaID]; ok {
+		return account.Credits
+	}
+	return 0
+}
+
+// Create a client for the account that sends its requests to the server
+func (s *Server) NewClient(account *Account) *gateway.Client {
+	return &gateway.Client{
+		ID:      account.ID,
+		Secret:  account.Secret,
+		Client:  s.Client(),
+		BaseURL: s.URL,
+	}
+}
+
+// Create an end-to-end client for the account that sends its requests to the server
+func (s *Server) NewEncryptedClient(account *Account) *gateway.EncryptedClient {
+	return &gateway.EncryptedClient{
+		Client:           s.NewClient(account),
+		EncryptionHelper: account.EncryptionHelper(),
+	}
+}
+
+// Make all following requests to the path (e.g. "/send_e2e") fail with the status code,
+// for example http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusRequestEntityTooLarge
+// or http.StatusInternalServerError. A status of zero removes the failure.
+func (s *Server) Fail(path string, status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if status == 0 {
+		delete(s.failures, path)
+	} else {
+		s.failures[path] = status
+	}
+}
+
+func (s *Server) withFailures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		status, ok := s.failures[r.URL.Path]
+		if !ok {
+			// Failures can also be registered for a prefix like "/pubkeys/"
+			for path, prefixStatus := range s.failures {
+				if strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path) {
+					status, ok = prefixStatus, true
+					break
+				}
+			}
+		}
+		s.mutex.Unlock()
+		if ok {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns all messages sent so far
+func (s *Server) SentMessages() []*SentMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*SentMessage(nil), s.sent...)
+}
+
+// Returns the last sent message or nil
+func (s *Server) LastMessage() *SentMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sent) == 0 {
+		return nil
+	}
+	return s.sent[len(s.sent)-1]
+}
+
+// Decrypt an end-to-end encrypted message with the secret key of the registered recipient
+func (s *Server) Decrypt(sent *SentMessage) (gateway.Message, error) {
+	s.mutex.Lock()
+	sender, recipient := s.identities[sent.From], s.identities[sent.To]
+	s.mutex.Unlock()
+	if sender == nil || recipient == nil {
+		return nil, gateway.ErrIDNotFound
+	}
+	if sent.Box == nil {
+		return nil, errors.New("message was not end-to-end encrypted")
+	}
+	return recipient.EncryptionHelper().DecryptMessage(sent.Box, sender.PublicKey, sent.Nonce)
+}
+
+// Returns the content of an uploaded blob
+func (s *Server) Blob(blobID *gateway.BlobID) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blob, ok := s.blobs[*blobID]
+	return blob, ok
+}
+
+// Create a signed callback request for the message sent from the identity to the account.
+func (s *Server) CallbackRequest(callbackURL string, from *Identity, to *Account, message gateway.Message) (*http.Request, error) {
+	encrypted, err := from.EncryptionHelper().EncryptMessage(message, to.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	messageID := new(gateway.MessageID)
+	if _, err = rand.Read(messageID[:]); err != nil {
+		return nil, err
+	}
+	return callback.NewRequest(callbackURL, &callback.EncryptedMessage{
+		From:      from.ID,
+		To:        to.ID,
+		MessageID: messageID,
+		Date:      time.Now(),
+		Nonce:     encrypted.Nonce,
+		Box:       encrypted.Box,
+	}, to.Secret)
+}
+
+// Deliver the message from the identity to the callback handler of the account and return the response.
+func (s *Server) SendCallback(handler http.Handler, from *Identity, to *Account, message gateway.Message) (*http.Response, error) {
+	request, err := s.CallbackRequest("http://localhost/callback", from, to, message)
+	if err != nil {
+		return nil, err
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Result(), nil
+}
+
+// Authenticate the request and return the account
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) *Account {
+	from, secret := r.FormValue("from"), r.FormValue("secret")
+	s.mutex.Lock()
+	account, ok := s.accounts[from]
+	s.mutex.Unlock()
+	if !ok || account.Secret != secret {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	return account
+}
+
+// Charge a credit from the account. The mutex must be held.
+func (s *Server) chargeLocked(w http.ResponseWriter, account *Account) bool {
+	if account.Credits <= 0 {
+		http.Error(w, "no credits remaining", http.StatusPaymentRequired)
+		return false
+	}
+	account.Credits--
+	return true
+}
+
+func randomHex(length int) string {
+	value := make([]byte, length)
+	_, _ = rand.Read(value)
+	return hex.EncodeToString(value)
+}
+
+func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
+	if s.authenticate(w, r) == nil {
+		return
+	}
+	s.mutex.Lock()
+	identity, ok := s.identities[strings.TrimPrefix(r.URL.Path, "/pubkeys/")]
+	s.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = fmt.Fprint(w, hex.EncodeToString(identity.PublicKey[:]))
+}
+
+func (s *Server) handleSendE2E(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account := s.authenticate(w, r)
+	if account == nil {
+		return
+	}
+	to := r.PostFormValue("to")
+	nonce, err := gateway.ReadHexNonce(r.PostFormValue("nonce"))
+	if err != nil {
+		http.Error(w, "invalid nonce", http.StatusBadRequest)
+		return
+	}
+	box, err := hex.DecodeString(r.PostFormValue("box"))
+	if err != nil {
+		http.Error(w, "invalid box", http.StatusBadRequest)
+		return
+	}
+	if len(box) > maxBoxSize {
+		http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.store(w, account, &SentMessage{From: account.ID, To: to, Nonce: nonce, Box: box})
+}
+
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account := s.authenticate(w, r)
+	if account == nil {
+		return
+	}
+	to := r.PostFormValue("to")
+	if to == "" {
+		if identity := s.lookup(r.PostFormValue("phone"), func(i *Identity) string { return i.Phone }); identity != nil {
+			to = identity.ID
+		} else if identity := s.lookup(strings.ToLower(r.PostFormValue("email")), func(i *Identity) string { return strings.ToLower(i.Email) }); identity != nil {
+			to = identity.ID
+		}
+	}
+	text := r.PostFormValue("text")
+	if len(text) > 3500 {
+		http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.store(w, account, &SentMessage{From: account.ID, To: to, Text: text})
+}
+
+// Store the message if the recipient exists and the account has credits, and respond with the message ID
+func (s *Server) store(w http.ResponseWriter, account *Account, message *SentMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.identities[message.To]; !ok {
+		http.Error(w, "invalid recipient", http.StatusBadRequest)
+		return
+	}
+	if !s.chargeLocked(w, account) {
+		return
+	}
+	message.MessageID = randomHex(8)
+	message.Time = time.Now()
+	s.sent = append(s.sent, message)
+	_, _ = fmt.Fprint(w, message.MessageID)
+}
+
+func (s *Server) handleUploadBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account := s.authenticate(w, r)
+	if account == nil {
+		return
+	}
+	maxBlobSize := s.MaxBlobSize
+	if maxBlobSize <= 0 {
+		maxBlobSize = DefaultMaxBlobSize
+	}
+	file, _, err := r.FormFile("blob")
+	if err != nil {
+		http.Error(w, "missing blob", http.StatusBadRequest)
+		return
+	}
+	content, err := ioutil.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		http.Error(w, "failed to read blob", http.StatusBadRequest)
+		return
+	}
+	if len(content) > maxBlobSize {
+		http.Error(w, "blob too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	blobID := new(gateway.BlobID)
+	_, _ = rand.Read(blobID[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.chargeLocked(w, account) {
+		return
+	}
+	s.blobs[*blobID] = content
+	_, _ = fmt.Fprint(w, hex.EncodeToString(blobID[:]))
+}
+
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	if s.authenticate(w, r) == nil {
+		return
+	}
+	blobID, err := gateway.ReadBlobID(strings.TrimPrefix(r.URL.Path, "/blobs/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	blob, ok := s.Blob(blobID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(blob)
+}
+
+func (s *Server) lookup(value string, field func(*Identity) string) *Identity {
+	if value == "" {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, identity := range s.identities {
+		if field(identity) == value {
+			return identity
+		}
+	}
+	return nil
+}
+
+func hashOrEmpty(value string, hash func(string) string) string {
+	if value == "" {
+		return ""
+	}
+	return hash(value)
+}
+
+func (s *Server) handleLookup(field func(*Identity) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authenticate(w, r) == nil {
+			return
+		}
+		value := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if strings.HasPrefix(r.URL.Path, "/lookup/email/") {
+			value = strings.ToLower(value)
+		}
+		identity := s.lookup(value, field)
+		if identity == nil {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprint(w, identity.ID)
+	}
+}
+
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if s.authenticate(w, r) == nil {
+		return
+	}
+	s.mutex.Lock()
+	identity, ok := s.identities[strings.TrimPrefix(r.URL.Path, "/capabilities/")]
+	s.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = fmt.Fprint(w, strings.Join(identity.Capabilities, ","))
+}
+
+func (s *Server) handleCredits(w http.ResponseWriter, r *http.Request) {
+	account := s.authenticate(w, r)
+	if account == nil {
+		return
+	}
+	_, _ = fmt.Fprint(w, strconv.Itoa(s.Credits(account.ID)))
+}
@@ -0,0 +1,87 @@
+package gatewaytest_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/gatewaytest"
+)
+
+func TestServer(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.NewIdentity("ECHOECHO"); err != nil {
+		t.Fatal(err)
+	}
+	client := server.NewEncryptedClient(account)
+
+	messageID, err := client.SendTextMessage("ECHOECHO", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := server.LastMessage()
+	if sent == nil || sent.MessageID != messageID || sent.From != "*TESTTST" || sent.To != "ECHOECHO" {
+		t.Fatalf("unexpected sent message %#v", sent)
+	}
+	message, err := server.Decrypt(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, ok := message.(*gateway.TextMessage); !ok || string(text.Content) != "Hello" {
+		t.Errorf("unexpected message %#v", message)
+	}
+	if credits := server.Credits("*TESTTST"); credits != 1 {
+		t.Errorf("%d credits left", credits)
+	}
+
+	if _, err = client.SendTextMessage("UNKNOWN1", "Hello"); err == nil {
+		t.Error("message to unknown identity was sent")
+	}
+	if _, err = client.SendTextMessage("ECHOECHO", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.SendTextMessage("ECHOECHO", "Hello"); err != gateway.ErrMissingCredits {
+		t.Errorf("expected ErrMissingCredits, got %v", err)
+	}
+	if sent := server.SentMessages(); len(sent) != 2 {
+		t.Errorf("%d messages sent", len(sent))
+	}
+}
+
+func TestServerBlobs(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.NewClient(account)
+
+	content := []byte("blob content")
+	blobID, err := client.UploadBlob(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, ok := server.Blob(blobID); !ok || !bytes.Equal(stored, content) {
+		t.Errorf("stored blob %q", stored)
+	}
+	downloaded, err := client.DownloadBlob(blobID)
+	if err != nil || !bytes.Equal(downloaded, content) {
+		t.Errorf("downloaded %q, %v", downloaded, err)
+	}
+
+	server.Fail("/blobs/", http.StatusInternalServerError)
+	if _, err = client.DownloadBlob(blobID); err == nil {
+		t.Error("failure was not applied to the prefix")
+	}
+	server.Fail("/blobs/", 0)
+	if _, err = client.DownloadBlob(blobID); err != nil {
+		t.Errorf("failure was not removed: %s", err)
+	}
+}
@@ -1,7 +1,53 @@
 package gateway
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// The HMAC keys of the Threema Gateway API for hashed lookups
 var (
-	emailMacKey [32]byte
+	emailMacKey = [32]byte{
+		0x30, 0xa5, 0x50, 0x0f, 0xed, 0x97, 0x01, 0xfa, 0x6d, 0xef, 0xdb, 0x61, 0x08, 0x41, 0x90, 0x0f,
+		0xeb, 0xb8, 0xe4, 0x30, 0x88, 0x1f, 0x7a, 0xd8, 0x16, 0x82, 0x62, 0x64, 0xec, 0x09, 0xba, 0xd7,
+	}
 
-	phoneMacKey [32]byte
+	phoneMacKey = [32]byte{
+		0x85, 0xad, 0xf8, 0x22, 0x69, 0x53, 0xf3, 0xd9, 0x6c, 0xfd, 0x5d, 0x09, 0xbf, 0x29, 0x55, 0x5e,
+		0xb9, 0x55, 0xfc, 0xd8, 0xaa, 0x5e, 0xc4, 0xf9, 0xfc, 0xd8, 0x69, 0xe2, 0x58, 0x37, 0x07, 0x23,
+	}
 )
+
+// Normalize the phone number to the E.164 format without '+', which is used for lookups.
+// All characters except digits are removed.
+func NormalizePhoneNumber(phoneNumber string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phoneNumber)
+}
+
+// Normalize the email address for lookups: surrounding whitespace is removed and it's converted to lowercase.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func hashLookupValue(key *[32]byte, value string) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the hex encoded hash of the normalized phone number, as used by LookupIDByPhoneHash
+func HashPhoneNumber(phoneNumber string) string {
+	return hashLookupValue(&phoneMacKey, NormalizePhoneNumber(phoneNumber))
+}
+
+// Returns the hex encoded hash of the normalized email address, as used by LookupIDByEmailHash
+func HashEmail(email string) string {
+	return hashLookupValue(&emailMacKey, NormalizeEmail(email))
+}
@@ -0,0 +1,25 @@
+package gateway
+
+import "testing"
+
+// Vectors of the Threema Gateway API documentation
+func TestHashes(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     func(string) string
+		value    string
+		expected string
+	}{
+		{"email", HashEmail, "test@threema.ch", "1ea093239cc5f0e1b6ec81b866265b921f26dc4033025410063309f4d1a8ee2c"},
+		{"normalized email", HashEmail, " Test@Threema.CH ", "1ea093239cc5f0e1b6ec81b866265b921f26dc4033025410063309f4d1a8ee2c"},
+		{"phone", HashPhoneNumber, "41791234567", "ad398f4d7ebe63c6550a486cc6e07f9baa09bd9d8b3d8cb9d9be106d35a7fdbc"},
+		{"formatted phone", HashPhoneNumber, "+41 79 123 45 67", "ad398f4d7ebe63c6550a486cc6e07f9baa09bd9d8b3d8cb9d9be106d35a7fdbc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if hash := test.hash(test.value); hash != test.expected {
+				t.Errorf("got %s, expected %s", hash, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	identityCodePrefix = "3mid:"
+	threemaURIScheme   = "threema"
+)
+
+var (
+	ErrInvalidIdentityCode = errors.New("invalid identity code")
+	ErrInvalidThreemaURI   = errors.New("invalid threema uri")
+	ErrPublicKeyMismatch   = errors.New("public key does not match the stored key of the identity")
+)
+
+// The IdentityCode is the payload of the QR code used by the Threema apps to verify a contact:
+// "3mid:IDENTITY,publickeyhex".
+type IdentityCode struct {
+	ID        string
+	PublicKey *PublicKey
+}
+
+// Parse an identity code as scanned from a QR code.
+func ParseIdentityCode(value string) (*IdentityCode, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, identityCodePrefix) {
+		return nil, ErrInvalidIdentityCode
+	}
+	parts := strings.Split(value[len(identityCodePrefix):], ",")
+	if len(parts) != 2 {
+		return nil, ErrInvalidIdentityCode
+	}
+	if err := checkIdentity(parts[0]); err != nil {
+		return nil, err
+	}
+	publicKey, err := ReadHexPublicKey(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityCode{
+		ID:        parts[0],
+		PublicKey: publicKey,
+	}, nil
+}
+
+// Returns the QR code payload of the identity code.
+func (i *IdentityCode) String() string {
+	return identityCodePrefix + i.ID + "," + hex.EncodeToString(i.PublicKey[:])
+}
+
+// Calculate the public key that belongs to the secret key.
+func PublicKeyFromSecretKey(secretKey *SecretKey) *PublicKey {
+	publicKey := new(PublicKey)
+	curve25519.ScalarBaseMult(publicKey, secretKey)
+	return publicKey
+}
+
+// Create the identity code of an own identity, for example the gateway ID.
+func NewIdentityCode(threemaID string, secretKey *SecretKey) (*IdentityCode, error) {
+	if err := checkIdentity(threemaID); err != nil {
+		return nil, err
+	}
+	return &IdentityCode{
+		ID:        threemaID,
+		PublicKey: PublicKeyFromSecretKey(secretKey),
+	}, nil
+}
+
+// The ThreemaURIAction is the action of a threema:// link
+type ThreemaURIAction string
+
+const (
+	// threema://add?id=IDENTITY adds the identity as contact
+	URIActionAdd ThreemaURIAction = "add"
+	// threema://compose?id=IDENTITY&text=TEXT opens a chat with a prepared text
+	URIActionCompose ThreemaURIAction = "compose"
+)
+
+// The ThreemaURI is a threema:// link to add a contact or to compose a message.
+type ThreemaURI struct {
+	Action ThreemaURIAction
+	ID     string
+	// The text is only used for compose links
+	Text string
+}
+
+// Parse a threema://add or threema://compose link.
+func ParseThreemaURI(value string) (*ThreemaURI, error) {
+	parsed, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != threemaURIScheme {
+		return nil, ErrInvalidThreemaURI
+	}
+	// threema://add is parsed with the action as host, threema:add as opaque value
+	action := parsed.Host
+	if action == "" {
+		action = parsed.Opaque
+	}
+	result := &ThreemaURI{
+		Action: ThreemaURIAction(action),
+		ID:     parsed.Query().Get("id"),
+	}
+	switch result.Action {
+	case URIActionAdd:
+	case URIActionCompose:
+		result.Text = parsed.Query().Get("text")
+	default:
+		return nil, fmt.Errorf("%w: unknown action %q", ErrInvalidThreemaURI, action)
+	}
+	if err = checkIdentity(result.ID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Returns the link as string
+func (u *ThreemaURI) String() string {
+	query := url.Values{"id": {u.ID}}
+	if u.Action == URIActionCompose && u.Text != "" {
+		query.Set("text", u.Text)
+	}
+	return (&url.URL{
+		Scheme:   threemaURIScheme,
+		Host:     string(u.Action),
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// Create a link that adds the identity as contact.
+func AddContactURI(threemaID string) string {
+	return (&ThreemaURI{Action: URIActionAdd, ID: threemaID}).String()
+}
+
+// Create a link that opens a chat with the identity and a prepared text.
+func ComposeURI(threemaID string, text string) string {
+	return (&ThreemaURI{Action: URIActionCompose, ID: threemaID, Text: text}).String()
+}
+
+// A VerifiedKeyStore additionally remembers whether a public key was verified in person (by scanning the identity code).
+type VerifiedKeyStore interface {
+	PublicKeyStore
+	MarkVerified(threemaID string) error
+	IsVerified(threemaID string) bool
+}
+
+// Store the public key of a scanned identity code.
+// If the store already contains a different key for the identity, ErrPublicKeyMismatch is returned.
+// If the store implements VerifiedKeyStore, the key is marked as verified.
+func VerifyIdentityCode(store PublicKeyStore, code *IdentityCode) error {
+	if existing := store.FetchPublicKey(code.ID); existing != nil && *existing != *code.PublicKey {
+		return ErrPublicKeyMismatch
+	}
+	if err := store.SavePublicKey(code.ID, code.PublicKey); err != nil {
+		return err
+	}
+	if verifiedStore, ok := store.(VerifiedKeyStore); ok {
+		return verifiedStore.MarkVerified(code.ID)
+	}
+	return nil
+}
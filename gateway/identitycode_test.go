@@ -0,0 +1,111 @@
+package gateway
+
+import "testing"
+
+func TestIdentityCode(t *testing.T) {
+	code, err := NewIdentityCode("ECHOECHO", filledKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "3mid:ECHOECHO,a4e09292b651c278b9772c569f5fa9bb13d906b46ab68c9df9dc2b4409f8a209"
+	if code.String() != expected {
+		t.Errorf("got %s, expected %s", code, expected)
+	}
+	parsed, err := ParseIdentityCode(expected + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ID != "ECHOECHO" || *parsed.PublicKey != *code.PublicKey {
+		t.Errorf("unexpected code %v", parsed)
+	}
+}
+
+func TestParseIdentityCodeErrors(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"ECHOECHO,a4e09292b651c278b9772c569f5fa9bb13d906b46ab68c9df9dc2b4409f8a209",
+		"3mid:ECHO,a4e09292b651c278b9772c569f5fa9bb13d906b46ab68c9df9dc2b4409f8a209",
+		"3mid:ECHOECHO,a4e0",
+		"3mid:ECHOECHO",
+		"3mid:ECHOECHO,a4e09292b651c278b9772c569f5fa9bb13d906b46ab68c9df9dc2b4409f8a209,x",
+	} {
+		if _, err := ParseIdentityCode(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestThreemaURI(t *testing.T) {
+	tests := []struct {
+		uri      string
+		expected ThreemaURI
+	}{
+		{AddContactURI("ECHOECHO"), ThreemaURI{Action: URIActionAdd, ID: "ECHOECHO"}},
+		{ComposeURI("ECHOECHO", "Hello & bye"), ThreemaURI{Action: URIActionCompose, ID: "ECHOECHO", Text: "Hello & bye"}},
+		{"threema://compose?id=ECHOECHO&text=Hi%20there", ThreemaURI{Action: URIActionCompose, ID: "ECHOECHO", Text: "Hi there"}},
+	}
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			parsed, err := ParseThreemaURI(test.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *parsed != test.expected {
+				t.Errorf("got %+v, expected %+v", parsed, test.expected)
+			}
+		})
+	}
+	if uri := AddContactURI("ECHOECHO"); uri != "threema://add?id=ECHOECHO" {
+		t.Errorf("unexpected add uri %s", uri)
+	}
+	for _, invalid := range []string{"https://threema.id/ECHOECHO", "threema://call?id=ECHOECHO", "threema://add?id=ECHO"} {
+		if _, err := ParseThreemaURI(invalid); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
+
+func TestVerifyIdentityCode(t *testing.T) {
+	store := NewInMemoryStore().(VerifiedKeyStore)
+	code := &IdentityCode{ID: "ECHOECHO", PublicKey: PublicKeyFromSecretKey(filledKey(1))}
+	if err := store.SavePublicKey("ECHOECHO", code.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if store.IsVerified("ECHOECHO") {
+		t.Error("key is verified before scanning the code")
+	}
+	if err := VerifyIdentityCode(store, code); err != nil {
+		t.Fatal(err)
+	}
+	if !store.IsVerified("ECHOECHO") {
+		t.Error("key is not verified after scanning the code")
+	}
+
+	forged := &IdentityCode{ID: "ECHOECHO", PublicKey: PublicKeyFromSecretKey(filledKey(2))}
+	if err := VerifyIdentityCode(store, forged); err != ErrPublicKeyMismatch {
+		t.Errorf("expected ErrPublicKeyMismatch, got %v", err)
+	}
+}
+
+func TestInMemoryStoreConcurrent(t *testing.T) {
+	store := NewInMemoryStore().(VerifiedKeyStore)
+	publicKey := PublicKeyFromSecretKey(filledKey(1))
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < 100; j++ {
+				_ = store.SavePublicKey("ECHOECHO", publicKey)
+				_ = store.MarkVerified("ECHOECHO")
+				store.FetchPublicKey("ECHOECHO")
+				store.IsVerified("ECHOECHO")
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	if !store.IsVerified("ECHOECHO") {
+		t.Error("key is not verified")
+	}
+}
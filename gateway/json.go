@@ -0,0 +1,346 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var messageTypeNames = map[MessageType]string{
+	TypeText:            "text",
+	TypeImage:           "image",
+	TypeLocation:        "location",
+	TypeVoice:           "voice",
+	TypePoll:            "poll",
+	TypeVote:            "vote",
+	TypeFile:            "file",
+	TypeGroupText:       "groupText",
+	TypeGroupImage:      "groupImage",
+	TypeGroupFile:       "groupFile",
+	TypeAddedToGroup:    "addedToGroup",
+	TypeGroupCreated:    "groupCreated",
+	TypeDeliveryReceipt: "deliveryReceipt",
+}
+
+// Returns the name of the type or the hex value (e.g. "0x42") of unknown types.
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+func (t MessageType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *MessageType) UnmarshalText(text []byte) error {
+	value := string(text)
+	for messageType, name := range messageTypeNames {
+		if name == value {
+			*t = messageType
+			return nil
+		}
+	}
+	if strings.HasPrefix(value, "0x") {
+		number, err := strconv.ParseUint(value[2:], 16, 8)
+		if err == nil {
+			*t = MessageType(number)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown message type %q", value)
+}
+
+var deliveryReceiptTypeNames = map[DeliveryReceiptType]string{
+	DeliveryReceived:     "received",
+	DeliveryRead:         "read",
+	DeliveryAcknowledged: "acknowledged",
+	DeliveryDeclined:     "declined",
+}
+
+func (d DeliveryReceiptType) String() string {
+	if name, ok := deliveryReceiptTypeNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(d))
+}
+
+func (d DeliveryReceiptType) MarshalText() ([]byte, error) {
+	name, ok := deliveryReceiptTypeNames[d]
+	if !ok {
+		return nil, fmt.Errorf("unknown delivery receipt type %d", byte(d))
+	}
+	return []byte(name), nil
+}
+
+func (d *DeliveryReceiptType) UnmarshalText(text []byte) error {
+	for deliveryType, name := range deliveryReceiptTypeNames {
+		if name == string(text) {
+			*d = deliveryType
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown delivery receipt type %q", text)
+}
+
+// Decodes the hex value into a fixed size destination
+func decodeHexField(name string, value string, destination []byte) error {
+	if len(value) != 2*len(destination) {
+		return fmt.Errorf("invalid length of %s", name)
+	}
+	_, err := hex.Decode(destination, []byte(value))
+	return err
+}
+
+type jsonTextMessage struct {
+	Text string `json:"text"`
+}
+
+func (t *TextMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonTextMessage{Text: string(t.Content)})
+}
+
+func (t *TextMessage) UnmarshalJSON(data []byte) error {
+	var value jsonTextMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	t.Content = []byte(value.Text)
+	return nil
+}
+
+type jsonImageMessage struct {
+	BlobID string `json:"blobId"`
+	Size   uint32 `json:"size"`
+	Nonce  string `json:"nonce"`
+}
+
+func (i *ImageMessage) MarshalJSON() ([]byte, error) {
+	value := &jsonImageMessage{Size: i.Size}
+	if i.BlobID != nil {
+		value.BlobID = hex.EncodeToString(i.BlobID[:])
+	}
+	if i.Nonce != nil {
+		value.Nonce = hex.EncodeToString(i.Nonce[:])
+	}
+	return json.Marshal(value)
+}
+
+func (i *ImageMessage) UnmarshalJSON(data []byte) error {
+	var value jsonImageMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	i.BlobID, i.Nonce, i.Size = new(BlobID), new(Nonce), value.Size
+	if err := decodeHexField("blobId", value.BlobID, i.BlobID[:]); err != nil {
+		return err
+	}
+	return decodeHexField("nonce", value.Nonce, i.Nonce[:])
+}
+
+type jsonFileMessage struct {
+	FileID      string `json:"fileId"`
+	ThumbnailID string `json:"thumbnailId,omitempty"`
+	SharedKey   string `json:"sharedKey"`
+	MimeType    string `json:"mimeType"`
+	FileName    string `json:"fileName,omitempty"`
+	FileSize    uint32 `json:"fileSize"`
+	Description string `json:"description,omitempty"`
+}
+
+func (f *FileMessage) MarshalJSON() ([]byte, error) {
+	value := &jsonFileMessage{
+		MimeType:    f.MimeType,
+		FileName:    f.FileName,
+		FileSize:    f.FileSize,
+		Description: f.Description,
+	}
+	if f.FileID != nil {
+		value.FileID = hex.EncodeToString(f.FileID[:])
+	}
+	if f.ThumbnailID != nil {
+		value.ThumbnailID = hex.EncodeToString(f.ThumbnailID[:])
+	}
+	if f.SharedKey != nil {
+		value.SharedKey = hex.EncodeToString(f.SharedKey[:])
+	}
+	return json.Marshal(value)
+}
+
+func (f *FileMessage) UnmarshalJSON(data []byte) error {
+	var value jsonFileMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	f.MimeType = value.MimeType
+	f.FileName = value.FileName
+	f.FileSize = value.FileSize
+	f.Description = value.Description
+	f.FileID, f.SharedKey, f.ThumbnailID = new(BlobID), new(SharedKey), nil
+	if err := decodeHexField("fileId", value.FileID, f.FileID[:]); err != nil {
+		return err
+	}
+	if err := decodeHexField("sharedKey", value.SharedKey, f.SharedKey[:]); err != nil {
+		return err
+	}
+	if value.ThumbnailID != "" {
+		f.ThumbnailID = new(BlobID)
+		return decodeHexField("thumbnailId", value.ThumbnailID, f.ThumbnailID[:])
+	}
+	return nil
+}
+
+type jsonDeliveryReceiptMessage struct {
+	DeliveryType DeliveryReceiptType `json:"deliveryType"`
+	MessageIDs   []string            `json:"messageIds"`
+}
+
+func (d *DeliveryReceiptMessage) MarshalJSON() ([]byte, error) {
+	value := &jsonDeliveryReceiptMessage{
+		DeliveryType: d.DeliveryType,
+		MessageIDs:   make([]string, 0, len(d.MessageIDs)),
+	}
+	for _, messageID := range d.MessageIDs {
+		value.MessageIDs = append(value.MessageIDs, hex.EncodeToString(messageID[:]))
+	}
+	return json.Marshal(value)
+}
+
+func (d *DeliveryReceiptMessage) UnmarshalJSON(data []byte) error {
+	var value jsonDeliveryReceiptMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	d.DeliveryType = value.DeliveryType
+	d.MessageIDs = make([]*MessageID, 0, len(value.MessageIDs))
+	for _, rawMessageID := range value.MessageIDs {
+		messageID := new(MessageID)
+		if err := decodeHexField("messageIds", rawMessageID, messageID[:]); err != nil {
+			return err
+		}
+		d.MessageIDs = append(d.MessageIDs, messageID)
+	}
+	return nil
+}
+
+type jsonVoiceMessage struct {
+	Seconds   uint16 `json:"seconds"`
+	BlobID    string `json:"blobId"`
+	Size      uint32 `json:"size"`
+	SharedKey string `json:"sharedKey"`
+}
+
+func (v *VoiceMessage) MarshalJSON() ([]byte, error) {
+	value := &jsonVoiceMessage{Seconds: v.Seconds, Size: v.Size}
+	if v.BlobID != nil {
+		value.BlobID = hex.EncodeToString(v.BlobID[:])
+	}
+	if v.SharedKey != nil {
+		value.SharedKey = hex.EncodeToString(v.SharedKey[:])
+	}
+	return json.Marshal(value)
+}
+
+func (v *VoiceMessage) UnmarshalJSON(data []byte) error {
+	var value jsonVoiceMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	v.Seconds, v.Size = value.Seconds, value.Size
+	v.BlobID, v.SharedKey = new(BlobID), new(SharedKey)
+	if err := decodeHexField("blobId", value.BlobID, v.BlobID[:]); err != nil {
+		return err
+	}
+	return decodeHexField("sharedKey", value.SharedKey, v.SharedKey[:])
+}
+
+type jsonGroupTextMessage struct {
+	SenderID string `json:"senderId"`
+	GroupID  string `json:"groupId"`
+	Content  string `json:"content"`
+}
+
+func (g *GroupTextMessage) MarshalJSON() ([]byte, error) {
+	value := &jsonGroupTextMessage{SenderID: g.SenderID, Content: g.Content}
+	if g.GroupID != nil {
+		value.GroupID = hex.EncodeToString(g.GroupID[:])
+	}
+	return json.Marshal(value)
+}
+
+func (g *GroupTextMessage) UnmarshalJSON(data []byte) error {
+	var value jsonGroupTextMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	g.SenderID, g.Content = value.SenderID, value.Content
+	g.GroupID = new(GroupID)
+	return decodeHexField("groupId", value.GroupID, g.GroupID[:])
+}
+
+type jsonOtherMessage struct {
+	MessageType MessageType `json:"messageType"`
+	Content     []byte      `json:"content"`
+}
+
+func (o *OtherMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonOtherMessage{MessageType: o.MessageType, Content: o.Content})
+}
+
+func (o *OtherMessage) UnmarshalJSON(data []byte) error {
+	var value jsonOtherMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	o.MessageType, o.Content = value.MessageType, value.Content
+	return nil
+}
+
+// The jsonMessage is the envelope of a message, containing its type
+type jsonMessage struct {
+	Type    MessageType     `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Encode the message as JSON object with the type name and the message:
+// {"type": "text", "message": {"text": "Hello"}}
+func MarshalMessage(message Message) ([]byte, error) {
+	content, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonMessage{
+		Type:    message.Type(),
+		Message: content,
+	})
+}
+
+// Returns true if the JSON object is an encoded OtherMessage
+func isOtherMessage(data []byte) bool {
+	var value struct {
+		MessageType *MessageType `json:"messageType"`
+	}
+	return json.Unmarshal(data, &value) == nil && value.MessageType != nil
+}
+
+// Decode a message encoded with MarshalMessage
+func UnmarshalMessage(data []byte) (Message, error) {
+	var envelope jsonMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	message := newMessage(envelope.Type)
+	if envelope.Type == TypeGroupText && !isOtherMessage(envelope.Message) {
+		message = &GroupTextMessage{}
+	}
+	if err := json.Unmarshal(envelope.Message, message); err != nil {
+		return nil, err
+	}
+	if other, ok := message.(*OtherMessage); ok {
+		other.MessageType = envelope.Type
+	}
+	return message, nil
+}
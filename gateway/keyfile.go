@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyFileVersion   = 1
+	keyFileSaltBytes = 16
+	// scrypt parameters recommended for interactive logins
+	keyFileScryptN = 32768
+	keyFileScryptR = 8
+	keyFileScryptP = 1
+)
+
+var (
+	ErrWrongPassphrase      = errors.New("wrong passphrase or corrupted key file")
+	ErrInvalidKeyFile       = errors.New("invalid key file")
+	ErrPassphraseRequired   = errors.New("key file is encrypted but no passphrase was given")
+	errUnsupportedKeyFormat = errors.New("unsupported key file version")
+)
+
+func deriveKeyFileKey(passphrase []byte, salt []byte) (*SharedKey, error) {
+	derived, err := scrypt.Key(passphrase, salt, keyFileScryptN, keyFileScryptR, keyFileScryptP, cryptoBoxSharedKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	key := new(SharedKey)
+	copy(key[:], derived)
+	wipe(derived)
+	return key, nil
+}
+
+// Encrypt the secret key with a passphrase, so it can be stored at rest.
+// The result is hex encoded and contains the format version, the salt, the nonce and the encrypted key.
+func EncryptSecretKey(secretKey *SecretKey, passphrase []byte) (string, error) {
+	salt := make([]byte, keyFileSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	nonce, err := CreateNonce()
+	if err != nil {
+		return "", err
+	}
+	key, err := deriveKeyFileKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(key[:])
+
+	result := make([]byte, 0, 1+keyFileSaltBytes+cryptoBoxNonceBytes+secretbox.Overhead+cryptoBoxSecretKeyBytes)
+	result = append(result, keyFileVersion)
+	result = append(result, salt...)
+	result = append(result, nonce[:]...)
+	result = secretbox.Seal(result, secretKey[:], nonce, key)
+	return hex.EncodeToString(result), nil
+}
+
+// Decrypt a secret key that was encrypted with EncryptSecretKey.
+func DecryptSecretKey(encrypted string, passphrase []byte) (*SecretKey, error) {
+	content, err := hex.DecodeString(strings.TrimSpace(encrypted))
+	if err != nil {
+		return nil, ErrInvalidKeyFile
+	}
+	if len(content) != 1+keyFileSaltBytes+cryptoBoxNonceBytes+secretbox.Overhead+cryptoBoxSecretKeyBytes {
+		return nil, ErrInvalidKeyFile
+	}
+	if content[0] != keyFileVersion {
+		return nil, errUnsupportedKeyFormat
+	}
+	content = content[1:]
+	salt := content[:keyFileSaltBytes]
+	nonce := new(Nonce)
+	copy(nonce[:], content[keyFileSaltBytes:])
+	key, err := deriveKeyFileKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key[:])
+
+	plaintext, ok := secretbox.Open(nil, content[keyFileSaltBytes+cryptoBoxNonceBytes:], nonce, key)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+	defer wipe(plaintext)
+	return checkSecKey(plaintext)
+}
+
+// Write the secret key encrypted with the passphrase to a file, which is only readable by the owner.
+func WriteKeyFile(path string, secretKey *SecretKey, passphrase []byte) error {
+	encrypted, err := EncryptSecretKey(secretKey, passphrase)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(encrypted+"\n"), 0600)
+}
+
+// Read a secret key from a file.
+// The file either contains the hex encoded secret key or a key encrypted with EncryptSecretKey.
+// For plain keys the passphrase is ignored.
+func ReadKeyFile(path string, passphrase []byte) (*SecretKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(content)
+	value := strings.TrimSpace(string(content))
+	if len(value) == 2*cryptoBoxSecretKeyBytes {
+		return ReadHexSecretKey(value)
+	}
+	if passphrase == nil {
+		return nil, ErrPassphraseRequired
+	}
+	return DecryptSecretKey(value, passphrase)
+}
+
+// Create a KeyProvider with the secret key from a key file. See ReadKeyFile.
+func NewKeyFileProvider(path string, passphrase []byte) (*SecretKeyProvider, error) {
+	secretKey, err := ReadKeyFile(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewSecretKeyProvider(secretKey), nil
+}
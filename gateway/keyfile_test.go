@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	encryptedPath := filepath.Join(dir, "encrypted")
+	if err = WriteKeyFile(encryptedPath, filledKey(1), []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	plainPath := filepath.Join(dir, "plain")
+	if err = ioutil.WriteFile(plainPath, []byte(hex.EncodeToString(filled(1, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		passphrase []byte
+		wantErr    error
+	}{
+		{"encrypted", encryptedPath, []byte("passphrase"), nil},
+		{"wrong passphrase", encryptedPath, []byte("wrong"), ErrWrongPassphrase},
+		{"missing passphrase", encryptedPath, nil, ErrPassphraseRequired},
+		{"plain", plainPath, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secretKey, err := ReadKeyFile(test.path, test.passphrase)
+			if err != test.wantErr {
+				t.Fatalf("got error %v, expected %v", err, test.wantErr)
+			}
+			if err == nil && *secretKey != *filledKey(1) {
+				t.Errorf("got key %x", secretKey[:])
+			}
+		})
+	}
+}
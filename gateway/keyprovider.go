@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+var ErrKeyDestroyed = errors.New("secret key has been destroyed")
+
+// A KeyProvider performs the operations that require the secret key of the own identity.
+// Implementations can keep the secret key outside of the process (for example in an external signer),
+// because only the public key and the keys shared with peers are handed out.
+type KeyProvider interface {
+	// Returns the public key of the own identity.
+	PublicKey() (*PublicKey, error)
+	// Calculates the key shared with the peer, as done by box.Precompute.
+	// The returned key is wiped by the caller after use, so a new key must be returned every time.
+	SharedKey(peersPublicKey *PublicKey) (*SharedKey, error)
+}
+
+// The SecretKeyProvider is a KeyProvider that holds the secret key in memory
+// until it is destroyed.
+type SecretKeyProvider struct {
+	mutex     sync.RWMutex
+	secretKey *SecretKey
+	destroyed bool
+	// Called when the key is destroyed, so derived keys can be wiped as well
+	onDestroy []func()
+}
+
+// A destroyableKeyProvider can be destroyed. Keys derived from it must not be used after it was destroyed.
+type destroyableKeyProvider interface {
+	Destroyed() bool
+	notifyDestroy(func())
+}
+
+// Create a KeyProvider for the secret key.
+// The provider takes ownership of the key and overwrites it when it is destroyed.
+func NewSecretKeyProvider(secretKey *SecretKey) *SecretKeyProvider {
+	return &SecretKeyProvider{
+		secretKey: secretKey,
+	}
+}
+
+func (p *SecretKeyProvider) PublicKey() (*PublicKey, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.secretKey == nil {
+		return nil, ErrKeyDestroyed
+	}
+	return PublicKeyFromSecretKey(p.secretKey), nil
+}
+
+func (p *SecretKeyProvider) SharedKey(peersPublicKey *PublicKey) (*SharedKey, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.secretKey == nil {
+		return nil, ErrKeyDestroyed
+	}
+	sharedKey := new(SharedKey)
+	box.Precompute(sharedKey, peersPublicKey, p.secretKey)
+	return sharedKey, nil
+}
+
+// Overwrite the secret key with zeros. All following operations fail with ErrKeyDestroyed.
+// The shared keys cached by EncryptionHelpers using the provider are wiped as well.
+func (p *SecretKeyProvider) Destroy() {
+	p.mutex.Lock()
+	if p.secretKey != nil {
+		wipe(p.secretKey[:])
+		p.secretKey = nil
+	}
+	p.destroyed = true
+	onDestroy := p.onDestroy
+	p.onDestroy = nil
+	p.mutex.Unlock()
+	for _, callback := range onDestroy {
+		callback()
+	}
+}
+
+// Returns whether Destroy was called
+func (p *SecretKeyProvider) Destroyed() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.destroyed
+}
+
+// Register a function called when the provider is destroyed.
+// If it's already destroyed, the function is called immediately.
+func (p *SecretKeyProvider) notifyDestroy(callback func()) {
+	p.mutex.Lock()
+	if !p.destroyed {
+		p.onDestroy = append(p.onDestroy, callback)
+		p.mutex.Unlock()
+		return
+	}
+	p.mutex.Unlock()
+	callback()
+}
+
+func wipe(value []byte) {
+	for i := range value {
+		value[i] = 0
+	}
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Capabilities of a Threema identity, as returned by LookupCapabilities
+const (
+	CapabilityText  = "text"
+	CapabilityImage = "image"
+	CapabilityVideo = "video"
+	CapabilityAudio = "audio"
+	CapabilityFile  = "file"
+)
+
+// The Capabilities list which message types the client of an identity can receive
+type Capabilities []string
+
+// Returns whether the capability is in the list
+func (c Capabilities) Has(capability string) bool {
+	for _, value := range c {
+		if value == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Send an authenticated GET request to the path and return the body.
+func (c *Client) get(path string) (string, error) {
+	response, err := c.client().Get(fmt.Sprintf("%s%s?from=%s&secret=%s",
+		c.baseURL(), path, url.QueryEscape(c.ID), url.QueryEscape(c.Secret)))
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if closeErr := response.Body.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		err = ErrIDNotFound
+	case http.StatusUnauthorized:
+		err = ErrBadSecret
+	case http.StatusPaymentRequired:
+		err = ErrMissingCredits
+	case http.StatusInternalServerError:
+		err = ErrInternalServerError
+	default:
+		err = ErrRequestFailed
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (c *Client) lookupID(kind string, value string) (string, error) {
+	if value == "" {
+		return "", ErrIDNotFound
+	}
+	return c.get("/lookup/" + kind + "/" + url.PathEscape(value))
+}
+
+// Lookup the Threema ID linked to the phone number. The number is normalized with NormalizePhoneNumber.
+// If no identity is found, ErrIDNotFound is returned.
+func (c *Client) LookupIDByPhone(phoneNumber string) (string, error) {
+	return c.lookupID("phone", NormalizePhoneNumber(phoneNumber))
+}
+
+// Lookup the Threema ID linked to the phone number with the hash created by HashPhoneNumber.
+// If no identity is found, ErrIDNotFound is returned.
+func (c *Client) LookupIDByPhoneHash(phoneHash string) (string, error) {
+	return c.lookupID("phone_hash", phoneHash)
+}
+
+// Lookup the Threema ID linked to the email address. The address is normalized with NormalizeEmail.
+// If no identity is found, ErrIDNotFound is returned.
+func (c *Client) LookupIDByEmail(email string) (string, error) {
+	return c.lookupID("email", NormalizeEmail(email))
+}
+
+// Lookup the Threema ID linked to the email address with the hash created by HashEmail.
+// If no identity is found, ErrIDNotFound is returned.
+func (c *Client) LookupIDByEmailHash(emailHash string) (string, error) {
+	return c.lookupID("email_hash", emailHash)
+}
+
+// Lookup the capabilities of the Threema identity.
+// If the identity doesn't exist, ErrIDNotFound is returned.
+func (c *Client) LookupCapabilities(threemaID string) (Capabilities, error) {
+	if err := checkIdentity(threemaID); err != nil {
+		return nil, err
+	}
+	body, err := c.get("/capabilities/" + url.PathEscape(threemaID))
+	if err != nil {
+		return nil, err
+	}
+	capabilities := Capabilities{}
+	for _, capability := range strings.Split(body, ",") {
+		if capability = strings.TrimSpace(capability); capability != "" {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities, nil
+}
+
+// Returns the number of credits left on the account
+func (c *Client) RemainingCredits() (int, error) {
+	body, err := c.get("/credits")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(body)
+}
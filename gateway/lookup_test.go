@@ -0,0 +1,70 @@
+package gateway_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/gatewaytest"
+)
+
+func TestLookups(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*GATEWAY", "secret", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := server.NewIdentity("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity.Phone = "41791234567"
+	identity.Email = "test@threema.ch"
+	identity.Capabilities = []string{gateway.CapabilityText, gateway.CapabilityFile}
+	client := server.NewClient(account)
+
+	lookups := []struct {
+		name   string
+		lookup func(string) (string, error)
+		value  string
+	}{
+		{"phone", client.LookupIDByPhone, "+41 79 123 45 67"},
+		{"phone hash", client.LookupIDByPhoneHash, gateway.HashPhoneNumber("41791234567")},
+		{"email", client.LookupIDByEmail, "Test@Threema.ch"},
+		{"email hash", client.LookupIDByEmailHash, gateway.HashEmail("test@threema.ch")},
+	}
+	for _, test := range lookups {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := test.lookup(test.value)
+			if err != nil || id != "ECHOECHO" {
+				t.Errorf("got %q, %v", id, err)
+			}
+			if _, err = test.lookup("unknown"); err != gateway.ErrIDNotFound {
+				t.Errorf("expected ErrIDNotFound, got %v", err)
+			}
+		})
+	}
+
+	capabilities, err := client.LookupCapabilities("ECHOECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(capabilities, gateway.Capabilities{"text", "file"}) || !capabilities.Has(gateway.CapabilityFile) || capabilities.Has(gateway.CapabilityImage) {
+		t.Errorf("unexpected capabilities %v", capabilities)
+	}
+
+	credits, err := client.RemainingCredits()
+	if err != nil || credits != 42 {
+		t.Errorf("got %d credits, %v", credits, err)
+	}
+	server.Fail("/lookup/phone/", http.StatusPaymentRequired)
+	if _, err = client.LookupIDByPhone("41791234567"); err != gateway.ErrMissingCredits {
+		t.Errorf("expected ErrMissingCredits, got %v", err)
+	}
+	client.Secret = "wrong"
+	if _, err = client.RemainingCredits(); err != gateway.ErrBadSecret {
+		t.Errorf("expected ErrBadSecret, got %v", err)
+	}
+}
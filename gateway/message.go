@@ -8,7 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/big"
+	"io"
 	"strings"
 )
 
@@ -43,18 +43,33 @@ func QuoteText(sender string, quote string, response string) string {
 	return "> " + sender + result + "\n" + response
 }
 
-// Returns a padding with a length between 1 and 255 (inclusive).
-func RandomPadding() []byte {
-	max := big.NewInt(254)
-	randomNumber, err := rand.Int(rand.Reader, max)
-	if err != nil {
-		panic(err)
+// Messages are padded to at least this length, as required by newer clients
+const MinPaddedLength = 32
+
+// Returns a padding with a random length between 1 and 255 (inclusive).
+func RandomPadding() ([]byte, error) {
+	return Padding(rand.Reader, 0, 0)
+}
+
+// Returns a PKCS#7 style padding for a message of contentLength bytes: the padding consists of
+// n bytes with the value n. The length is chosen randomly between 1 and 255 with bytes read from random,
+// but the padded message is at least minPaddedLength bytes long.
+func Padding(random io.Reader, contentLength int, minPaddedLength int) ([]byte, error) {
+	var padLen int
+	randomByte := make([]byte, 1)
+	for padLen == 0 {
+		if _, err := io.ReadFull(random, randomByte); err != nil {
+			return nil, err
+		}
+		padLen = int(randomByte[0])
+	}
+	if contentLength+padLen < minPaddedLength {
+		padLen = minPaddedLength - contentLength
+	}
+	if padLen > 255 {
+		return nil, errors.New("minimum padded length is too long")
 	}
-	padLen := int(randomNumber.Int64()) + 1
-	padding := make([]byte, 1, padLen)
-	padding[0] = byte(padLen)
-	padding = bytes.Repeat(padding, padLen)
-	return padding
+	return bytes.Repeat([]byte{byte(padLen)}, padLen), nil
 }
 
 type TextMessage struct {
@@ -189,7 +204,7 @@ func (d *DeliveryReceiptMessage) Type() MessageType {
 }
 
 func (d *DeliveryReceiptMessage) PackContent() []byte {
-	content := make([]byte, 1+(messageIdBytes*len(d.MessageIDs)))
+	content := make([]byte, 0, 1+(messageIdBytes*len(d.MessageIDs)))
 	content = append(content, byte(d.DeliveryType))
 	for _, messageId := range d.MessageIDs {
 		content = append(content, messageId[:]...)
@@ -231,6 +246,9 @@ func (v *VoiceMessage) Type() MessageType {
 }
 
 func (v *VoiceMessage) Unpack(content []byte) error {
+	if len(content) != 6+blobIdBytes+cryptoBoxSharedKeyBytes {
+		return fmt.Errorf("invalid voice message size %d != %d", len(content), 6+blobIdBytes+cryptoBoxSharedKeyBytes)
+	}
 	v.Seconds = binary.LittleEndian.Uint16(content)
 	v.BlobID = new(BlobID)
 	content = content[2:]
@@ -262,6 +280,9 @@ func ReadSharedKey(hexKey string) (*SharedKey, error) {
 }
 
 func removePadding(content []byte) ([]byte, error) {
+	if len(content) == 0 {
+		return nil, errors.New("message is empty")
+	}
 	paddingLength := int(content[len(content)-1])
 	if paddingLength == 0 {
 		return nil, errors.New("padding is 0")
@@ -272,6 +293,24 @@ func removePadding(content []byte) ([]byte, error) {
 	return content[:len(content)-paddingLength], nil
 }
 
+// Create an empty message of the type. Unknown types and group messages are read as OtherMessage.
+func newMessage(messageType MessageType) Message {
+	switch messageType {
+	case TypeText:
+		return &TextMessage{}
+	case TypeFile:
+		return &FileMessage{}
+	case TypeImage:
+		return &ImageMessage{}
+	case TypeDeliveryReceipt:
+		return &DeliveryReceiptMessage{}
+	case TypeVoice:
+		return &VoiceMessage{}
+	default:
+		return &OtherMessage{MessageType: messageType}
+	}
+}
+
 func unpackMessage(msg Message, content []byte) (Message, error) {
 	err := msg.Unpack(content)
 	return msg, err
@@ -296,10 +335,11 @@ func (o *OtherMessage) Unpack(content []byte) error {
 }
 
 func (o *OtherMessage) String() string {
-	return fmt.Sprintf("OtherMessage type=%d, content=%s", o.Type, string(o.Content))
+	return fmt.Sprintf("OtherMessage type=%d, content=%s", o.MessageType, string(o.Content))
 }
 
 type GroupTextMessage struct {
+	// The identity of the group creator
 	SenderID string
 	GroupID  *GroupID
 	Content  string
@@ -310,6 +350,9 @@ func (g *GroupTextMessage) Type() MessageType {
 }
 
 func (g *GroupTextMessage) Unpack(content []byte) error {
+	if len(content) < 8+groupIdBytes {
+		return errors.New("invalid group text message length")
+	}
 	g.SenderID = string(content[:8])
 	g.GroupID = new(GroupID)
 	copy(g.GroupID[:], content[8:16])
@@ -325,13 +368,22 @@ func (g *GroupTextMessage) PackContent() []byte {
 	return result
 }
 
-func PackMessage(message Message) []byte {
+// Pack the message with a random padding, so the padded message is at least MinPaddedLength bytes long.
+func PackMessage(message Message) ([]byte, error) {
+	return PackMessageWithPadding(message, rand.Reader, MinPaddedLength)
+}
+
+// Pack the message with a padding created from random. See Padding.
+func PackMessageWithPadding(message Message, random io.Reader, minPaddedLength int) ([]byte, error) {
 	content := message.PackContent()
-	padding := RandomPadding()
+	padding, err := Padding(random, 1+len(content), minPaddedLength)
+	if err != nil {
+		return nil, err
+	}
 	result := make([]byte, 0, 1+len(content)+len(padding))
 	result = append(result, byte(message.Type()))
 	result = append(result, content...)
-	return append(result, padding...)
+	return append(result, padding...), nil
 }
 
 func ReadMessage(content []byte) (Message, error) {
@@ -343,21 +395,5 @@ func ReadMessage(content []byte) (Message, error) {
 	if len(content) < 2 {
 		return nil, errors.New("message has no content")
 	}
-	switch MessageType(content[0]) {
-	case TypeText:
-		return unpackMessage(&TextMessage{}, content[1:])
-	case TypeFile:
-		return unpackMessage(&FileMessage{}, content[1:])
-	case TypeImage:
-		return unpackMessage(&ImageMessage{}, content[1:])
-	case TypeDeliveryReceipt:
-		return unpackMessage(&DeliveryReceiptMessage{}, content[1:])
-	case TypeVoice:
-		return unpackMessage(&VoiceMessage{}, content[1:])
-	default:
-		return &OtherMessage{
-			MessageType: MessageType(content[0]),
-			Content:     content[1:],
-		}, nil
-	}
+	return unpackMessage(newMessage(MessageType(content[0])), content[1:])
 }
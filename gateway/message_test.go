@@ -0,0 +1,253 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testBlobID(value byte) *BlobID {
+	blobID := new(BlobID)
+	copy(blobID[:], filled(value, blobIdBytes))
+	return blobID
+}
+
+func testMessageID(value byte) *MessageID {
+	messageID := new(MessageID)
+	copy(messageID[:], filled(value, messageIdBytes))
+	return messageID
+}
+
+func testGroupID(value byte) *GroupID {
+	groupID := new(GroupID)
+	copy(groupID[:], filled(value, groupIdBytes))
+	return groupID
+}
+
+// The framing of the messages as sent over the wire without padding.
+// The layouts are the end-to-end message formats of the Threema Gateway API documentation,
+// the values are arbitrary, so these vectors guard against regressions and not against
+// misreading the documentation.
+var messageVectors = []struct {
+	name    string
+	content string
+	message Message
+}{
+	{
+		"text",
+		"01" + hex.EncodeToString([]byte("Hello")),
+		&TextMessage{Content: []byte("Hello")},
+	},
+	{
+		"image",
+		"02" + strings.Repeat("11", 16) + "e8030000" + strings.Repeat("22", 24),
+		&ImageMessage{BlobID: testBlobID(0x11), Size: 1000, Nonce: filledNonce(0x22)},
+	},
+	{
+		"file",
+		"17" + hex.EncodeToString([]byte(`{"b":"`+strings.Repeat("11", 16)+`","t":"`+strings.Repeat("22", 16)+`","k":"`+strings.Repeat("33", 32)+`","m":"text/plain","n":"a.txt","s":5,"i":0,"d":"desc"}`)),
+		&FileMessage{
+			FileID:      testBlobID(0x11),
+			ThumbnailID: testBlobID(0x22),
+			SharedKey:   filledKey(0x33),
+			MimeType:    "text/plain",
+			FileName:    "a.txt",
+			FileSize:    5,
+			Description: "desc",
+		},
+	},
+	{
+		"delivery receipt",
+		"80" + "02" + strings.Repeat("01", 8) + strings.Repeat("02", 8),
+		&DeliveryReceiptMessage{DeliveryType: DeliveryRead, MessageIDs: []*MessageID{testMessageID(1), testMessageID(2)}},
+	},
+	{
+		"voice",
+		"14" + "0a00" + strings.Repeat("11", 16) + "00040000" + strings.Repeat("33", 32),
+		&VoiceMessage{Seconds: 10, BlobID: testBlobID(0x11), Size: 1024, SharedKey: filledKey(0x33)},
+	},
+	{
+		"group text",
+		"41" + hex.EncodeToString([]byte("ECHOECHO")) + strings.Repeat("44", 8) + hex.EncodeToString([]byte("Hi group")),
+		// Group messages are not decoded by ReadMessage, see TestGroupTextMessage
+		&OtherMessage{MessageType: TypeGroupText, Content: append(append([]byte("ECHOECHO"), filled(0x44, 8)...), "Hi group"...)},
+	},
+	{
+		"unknown type",
+		"10" + "abcdef",
+		&OtherMessage{MessageType: TypeLocation, Content: []byte{0xab, 0xcd, 0xef}},
+	},
+}
+
+func TestReadMessageVectors(t *testing.T) {
+	for _, test := range messageVectors {
+		t.Run(test.name, func(t *testing.T) {
+			for _, padding := range [][]byte{{1}, filled(3, 3), filled(255, 255)} {
+				content := append(mustDecodeHex(t, test.content), padding...)
+				message, err := ReadMessage(content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(message, test.message) {
+					t.Errorf("got %#v, expected %#v", message, test.message)
+				}
+			}
+		})
+	}
+}
+
+func TestPackMessageVectors(t *testing.T) {
+	for _, test := range messageVectors {
+		t.Run(test.name, func(t *testing.T) {
+			expected := mustDecodeHex(t, test.content)
+			packed, err := PackMessage(test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packed) < MinPaddedLength {
+				t.Errorf("packed message has only %d bytes", len(packed))
+			}
+			if !bytes.HasPrefix(packed, expected) {
+				t.Fatalf("got %x, expected prefix %s", packed, test.content)
+			}
+			padding := packed[len(expected):]
+			if len(padding) < 1 || len(padding) > 255 || !bytes.Equal(padding, filled(byte(len(padding)), len(padding))) {
+				t.Errorf("invalid padding %x", padding)
+			}
+			message, err := ReadMessage(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(message, test.message) {
+				t.Errorf("got %#v, expected %#v", message, test.message)
+			}
+		})
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"zero padding", "0168690000"},
+		{"padding longer than message", "016805"},
+		{"type without content", "0101"},
+		{"short image", "02" + strings.Repeat("11", 16) + "01"},
+		{"short voice", "14" + "0a00" + strings.Repeat("11", 16) + "01"},
+		{"receipt without ids", "8002" + "01"},
+		{"receipt with partial id", "8002" + strings.Repeat("01", 7) + "01"},
+		{"receipt with invalid type", "8005" + strings.Repeat("01", 8) + "01"},
+		{"invalid file json", "17" + hex.EncodeToString([]byte("{")) + "01"},
+		{"file with short key", "17" + hex.EncodeToString([]byte(`{"b":"`+strings.Repeat("11", 16)+`","k":"33","m":"a/b","s":1}`)) + "01"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if message, err := ReadMessage(mustDecodeHex(t, test.content)); err == nil {
+				t.Errorf("expected error, got %#v", message)
+			}
+		})
+	}
+}
+
+func TestRandomPadding(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		padding, err := RandomPadding()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padding) < 1 || len(padding) > 255 {
+			t.Fatalf("invalid padding length %d", len(padding))
+		}
+		if !bytes.Equal(padding, filled(byte(len(padding)), len(padding))) {
+			t.Fatalf("invalid padding %x", padding)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		name          string
+		random        []byte
+		contentLength int
+		minLength     int
+		expected      int
+		wantErr       bool
+	}{
+		{"random length", []byte{7}, 40, 32, 7, false},
+		{"zero is skipped", []byte{0, 0, 3}, 40, 32, 3, false},
+		{"minimum length", []byte{7}, 5, 32, 27, false},
+		{"without minimum", []byte{1}, 5, 0, 1, false},
+		{"minimum too long", []byte{1}, 5, 300, 0, true},
+		{"random exhausted", []byte{0}, 5, 32, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			padding, err := Padding(bytes.NewReader(test.random), test.contentLength, test.minLength)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !bytes.Equal(padding, filled(byte(test.expected), test.expected)) {
+				t.Errorf("got %x, expected %d bytes of %d", padding, test.expected, test.expected)
+			}
+		})
+	}
+}
+
+func TestMessageJSONRoundTrip(t *testing.T) {
+	for _, test := range messageVectors {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := MarshalMessage(test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := UnmarshalMessage(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.message) {
+				t.Errorf("got %#v, expected %#v", decoded, test.message)
+			}
+		})
+	}
+}
+
+func TestMarshalMessage(t *testing.T) {
+	encoded, err := MarshalMessage(&DeliveryReceiptMessage{DeliveryType: DeliveryAcknowledged, MessageIDs: []*MessageID{testMessageID(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"deliveryReceipt","message":{"deliveryType":"acknowledged","messageIds":["0101010101010101"]}}`
+	if string(encoded) != expected {
+		t.Errorf("got %s, expected %s", encoded, expected)
+	}
+}
+
+func TestGroupTextMessage(t *testing.T) {
+	expected := &GroupTextMessage{SenderID: "ECHOECHO", GroupID: testGroupID(0x44), Content: "Hi group"}
+	message := new(GroupTextMessage)
+	if err := message.Unpack(append(append([]byte("ECHOECHO"), filled(0x44, 8)...), "Hi group"...)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(message, expected) {
+		t.Errorf("got %#v, expected %#v", message, expected)
+	}
+	if err := new(GroupTextMessage).Unpack([]byte("ECHO")); err == nil {
+		t.Error("short content was accepted")
+	}
+
+	encoded, err := MarshalMessage(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalMessage(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("got %#v, expected %#v", decoded, expected)
+	}
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+// The Event is the normalized JSON representation of a received message that is posted to the webhooks.
+type Event struct {
+	// The message ID (hex encoded)
+	MessageID string `json:"messageId"`
+	// The identity of the sender
+	From string `json:"from"`
+	// The gateway identity the message was sent to
+	To string `json:"to"`
+	// The public nickname of the sender, if set
+	Nickname string    `json:"nickname,omitempty"`
+	Date     time.Time `json:"date"`
+	// The message type: text, image, file, voice, deliveryReceipt or other
+	Type string `json:"type"`
+	// The raw message type byte
+	RawType gateway.MessageType `json:"rawType"`
+
+	Text    string   `json:"text,omitempty"`
+	File    *File    `json:"file,omitempty"`
+	Receipt *Receipt `json:"receipt,omitempty"`
+	// The content of other messages
+	Content []byte `json:"content,omitempty"`
+}
+
+// File contains the metadata of a received file, image or voice message
+type File struct {
+	Name        string `json:"name,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+	Size        uint32 `json:"size"`
+	Description string `json:"description,omitempty"`
+	// The length of a voice message in seconds
+	Seconds uint16 `json:"seconds,omitempty"`
+	// A link to the decrypted content, if the relay serves the content
+	ContentURL string `json:"contentUrl,omitempty"`
+}
+
+// Receipt contains the state of a delivery receipt
+type Receipt struct {
+	// received, read, acknowledged or declined
+	Status     string   `json:"status"`
+	MessageIDs []string `json:"messageIds"`
+}
+
+// Create the event of the message. Links to the content of files are created with contentURL,
+// which may return an empty string to omit the link.
+func newEvent(message *callback.DecryptedMessage, contentURL func(content) string) *Event {
+	event := &Event{
+		MessageID: hex.EncodeToString(message.MessageID[:]),
+		From:      message.From,
+		To:        message.To,
+		Nickname:  message.Nickname,
+		Date:      message.Date,
+		RawType:   message.Message.Type(),
+	}
+	switch m := message.Message.(type) {
+	case *gateway.TextMessage:
+		event.Type = "text"
+		event.Text = string(m.Content)
+	case *gateway.FileMessage:
+		event.Type = "file"
+		event.File = &File{
+			Name:        m.FileName,
+			MimeType:    m.MimeType,
+			Size:        m.FileSize,
+			Description: m.Description,
+			ContentURL:  contentURL(content{blobID: m.FileID, sharedKey: m.SharedKey, mimeType: m.MimeType}),
+		}
+	case *gateway.ImageMessage:
+		event.Type = "image"
+		event.File = &File{
+			MimeType:   "image/jpeg",
+			Size:       m.Size,
+			ContentURL: contentURL(content{blobID: m.BlobID, nonce: m.Nonce, publicKey: message.SenderPublicKey, mimeType: "image/jpeg"}),
+		}
+	case *gateway.VoiceMessage:
+		event.Type = "voice"
+		event.File = &File{
+			MimeType:   "audio/mp4",
+			Size:       m.Size,
+			Seconds:    m.Seconds,
+			ContentURL: contentURL(content{blobID: m.BlobID, sharedKey: m.SharedKey, mimeType: "audio/mp4"}),
+		}
+	case *gateway.DeliveryReceiptMessage:
+		event.Type = "deliveryReceipt"
+		event.Receipt = &Receipt{
+			Status:     m.DeliveryType.String(),
+			MessageIDs: make([]string, 0, len(m.MessageIDs)),
+		}
+		for _, messageID := range m.MessageIDs {
+			event.Receipt.MessageIDs = append(event.Receipt.MessageIDs, hex.EncodeToString(messageID[:]))
+		}
+	case *gateway.OtherMessage:
+		event.Type = "other"
+		event.Content = m.Content
+	default:
+		event.Type = "other"
+		event.Content = m.PackContent()
+	}
+	return event
+}
@@ -0,0 +1,329 @@
+/*
+Package relay forwards received messages as signed JSON to internal webhooks,
+so other services can react to messages without access to the gateway secrets.
+*/
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+const (
+	// The header containing the signature of the request body
+	SignatureHeader = "X-Threema-Relay-Signature"
+	// The header containing the unix timestamp that is included in the signature
+	TimestampHeader = "X-Threema-Relay-Timestamp"
+
+	DefaultMaxRetries = 3
+	DefaultRetryDelay = time.Second
+	DefaultContentTTL = 24 * time.Hour
+	// The default number of links to contents that are kept at the same time
+	DefaultMaxContents = 10000
+	// The default timeout of a request to a webhook
+	DefaultTimeout = 10 * time.Second
+
+	contentTokenBytes = 16
+)
+
+// Returned by HandleMessage after the relay was closed
+var ErrClosed = errors.New("relay is closed")
+
+// A content that can be downloaded through the relay
+type content struct {
+	blobID    *gateway.BlobID
+	sharedKey *gateway.SharedKey
+	nonce     *gateway.Nonce
+	publicKey *gateway.PublicKey
+	mimeType  string
+	expires   time.Time
+}
+
+// The client used to call the webhooks if Relay.HTTPClient is nil
+var defaultHTTPClient = &http.Client{Timeout: DefaultTimeout}
+
+// The Relay posts every received message as Event to the webhook URLs.
+// The body is signed with HMAC-SHA256, see Sign.
+// The events are posted in the background, Close waits until they are delivered.
+type Relay struct {
+	Client *gateway.EncryptedClient
+
+	// The webhooks receiving the events
+	URLs []string
+
+	// The secret used to sign the requests
+	Secret []byte
+
+	// If set, events of files contain a link to the decrypted content below this URL.
+	// The Relay must be served as http.Handler at this URL.
+	ContentBaseURL string
+
+	// How long the links to decrypted contents are valid. If zero, DefaultContentTTL is used.
+	ContentTTL time.Duration
+
+	// The maximum number of valid links. If exceeded, the link expiring first is removed.
+	// If zero, DefaultMaxContents is used.
+	MaxContents int
+
+	// The number of retries for each webhook. If zero, DefaultMaxRetries is used.
+	MaxRetries int
+
+	// The delay before the first retry, which doubles with every retry. If zero, DefaultRetryDelay is used.
+	RetryDelay time.Duration
+
+	// The client used to call the webhooks. If nil, a client with the timeout DefaultTimeout is used.
+	HTTPClient *http.Client
+
+	// Logger for webhooks that failed after all retries. If nil, errors are logged to stderr.
+	ErrorLog *log.Logger
+
+	mutex    sync.Mutex
+	contents map[string]*content
+
+	initOnce sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+}
+
+// Create a relay posting the events to the URLs
+func New(client *gateway.EncryptedClient, secret []byte, urls ...string) *Relay {
+	return &Relay{
+		Client: client,
+		URLs:   urls,
+		Secret: secret,
+	}
+}
+
+func (r *Relay) httpClient() *http.Client {
+	if r.HTTPClient != nil {
+		return r.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+func (r *Relay) init() {
+	r.initOnce.Do(func() {
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+	})
+}
+
+func (r *Relay) logf(format string, v ...interface{}) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, v...)
+	} else {
+		log.New(os.Stderr, "", log.LstdFlags).Printf(format, v...)
+	}
+}
+
+// Close cancels the pending retries of failed webhooks and waits until the running requests are finished.
+// Afterwards HandleMessage refuses new messages with ErrClosed.
+func (r *Relay) Close() error {
+	r.init()
+	r.mutex.Lock()
+	r.cancel()
+	r.mutex.Unlock()
+	r.workers.Wait()
+	return nil
+}
+
+// Calculate the signature of the body with the timestamp
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify the signature of a request of the relay. Webhooks should additionally check
+// that the timestamp is recent, to prevent replays.
+func Verify(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// HandleMessage is a callback.MessageHandlerFunc posting the message to all webhooks.
+// The webhooks are called in the background, so a failing webhook neither blocks the callback
+// nor causes duplicate events for the other webhooks. Webhooks that failed after all retries are logged.
+func (r *Relay) HandleMessage(message *callback.DecryptedMessage) error {
+	r.init()
+	body, err := json.Marshal(newEvent(message, r.contentURL))
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	if r.ctx.Err() != nil {
+		r.mutex.Unlock()
+		return ErrClosed
+	}
+	r.workers.Add(len(r.URLs))
+	r.mutex.Unlock()
+	for _, url := range r.URLs {
+		go func(url string) {
+			defer r.workers.Done()
+			if err := r.post(r.ctx, url, body); err != nil {
+				r.logf("relay of message %x to %s failed: %s", message.MessageID[:], url, err)
+			}
+		}(url)
+	}
+	return nil
+}
+
+// Post the body to the URL and retry on network errors, 429 and 5xx responses until the context is canceled
+func (r *Relay) post(ctx context.Context, url string, body []byte) (err error) {
+	maxRetries := r.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	delay := r.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = r.postOnce(url, body)
+		if err == nil || !retry || attempt >= maxRetries {
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		delay *= 2
+	}
+}
+
+func (r *Relay) postOnce(url string, body []byte) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(r.Secret, timestamp, body))
+	response, err := r.httpClient().Do(request)
+	if err != nil {
+		return true, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry = response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %s", response.Status)
+}
+
+// Register the content and return the link to it
+func (r *Relay) contentURL(c content) string {
+	if r.ContentBaseURL == "" || c.blobID == nil {
+		return ""
+	}
+	tokenBytes := make([]byte, contentTokenBytes)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return ""
+	}
+	token := hex.EncodeToString(tokenBytes)
+	ttl := r.ContentTTL
+	if ttl <= 0 {
+		ttl = DefaultContentTTL
+	}
+	c.expires = time.Now().Add(ttl)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.contents == nil {
+		r.contents = make(map[string]*content)
+	}
+	maxContents := r.MaxContents
+	if maxContents <= 0 {
+		maxContents = DefaultMaxContents
+	}
+	now := time.Now()
+	var firstToken string
+	for existingToken, existing := range r.contents {
+		if now.After(existing.expires) {
+			delete(r.contents, existingToken)
+		} else if firstToken == "" || existing.expires.Before(r.contents[firstToken].expires) {
+			firstToken = existingToken
+		}
+	}
+	if len(r.contents) >= maxContents {
+		delete(r.contents, firstToken)
+	}
+	r.contents[token] = &c
+	return strings.TrimSuffix(r.ContentBaseURL, "/") + "/" + token
+}
+
+func (r *Relay) lookupContent(token string) *content {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.contents[token]
+	if !ok || time.Now().After(c.expires) {
+		return nil
+	}
+	return c
+}
+
+// Serve the decrypted content of the links in the events.
+// The last path segment of the request is the token of the content.
+// The MIME type is chosen by the sender, so the content is always served as download
+// and browsers must not guess another type.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	c := r.lookupContent(token)
+	if c == nil {
+		http.NotFound(w, req)
+		return
+	}
+	var plaintext []byte
+	var err error
+	if c.sharedKey != nil {
+		plaintext, err = r.Client.DownloadFile(c.blobID, c.sharedKey)
+	} else {
+		plaintext, err = r.Client.DownloadImage(c.blobID, c.nonce, c.publicKey)
+	}
+	if err == gateway.ErrBlobNotFound {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, "download failed", http.StatusBadGateway)
+		return
+	}
+	contentType := "application/octet-stream"
+	if _, _, err := mime.ParseMediaType(c.mimeType); err == nil {
+		contentType = c.mimeType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(plaintext)))
+	_, _ = w.Write(plaintext)
+}
@@ -0,0 +1,221 @@
+package relay_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+	"github.com/coffeemakr/threema/gateway/gatewaytest"
+	"github.com/coffeemakr/threema/gateway/relay"
+)
+
+func textMessage(text string) *callback.DecryptedMessage {
+	return &callback.DecryptedMessage{
+		EncryptedMessage: &callback.EncryptedMessage{
+			From:      "ECHOECHO",
+			To:        "*TESTTST",
+			MessageID: new(gateway.MessageID),
+			Date:      time.Unix(1600000000, 0),
+		},
+		Message: &gateway.TextMessage{Content: []byte(text)},
+	}
+}
+
+func TestRelay(t *testing.T) {
+	secret := []byte("secret")
+	events := make(chan *relay.Event, 10)
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !relay.Verify(secret, r.Header.Get(relay.TimestampHeader), body, r.Header.Get(relay.SignatureHeader)) {
+			t.Error("invalid signature")
+		}
+		event := new(relay.Event)
+		if err = json.Unmarshal(body, event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer working.Close()
+	var failures int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failures, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	r := relay.New(nil, secret, working.URL, failing.URL)
+	r.MaxRetries = 2
+	r.RetryDelay = time.Millisecond
+	r.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if err := r.HandleMessage(textMessage("Hello")); err != nil {
+		t.Fatalf("failing webhook failed the callback: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&failures) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events posted", len(events))
+	}
+	if event := <-events; event.Type != "text" || event.Text != "Hello" || event.From != "ECHOECHO" {
+		t.Errorf("unexpected event %#v", event)
+	}
+	if failures != 3 {
+		t.Errorf("failing webhook called %d times", failures)
+	}
+}
+
+func TestRelayCloseStopsRetries(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	r := relay.New(nil, []byte("secret"), failing.URL)
+	r.RetryDelay = time.Hour
+	r.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if err := r.HandleMessage(textMessage("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		_ = r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the retry delay")
+	}
+}
+
+func TestRelayRefusesMessagesAfterClose(t *testing.T) {
+	r := relay.New(nil, []byte("secret"), "http://127.0.0.1:1/")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.HandleMessage(textMessage("Hello")); err != relay.ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+// Relay file messages and return the content links of the events
+func relayFiles(t *testing.T, r *relay.Relay, messages ...*gateway.FileMessage) []string {
+	t.Helper()
+	events := make(chan *relay.Event, len(messages))
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		event := new(relay.Event)
+		if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+	r.URLs = []string{webhook.URL}
+	var urls []string
+	for _, message := range messages {
+		decrypted := textMessage("")
+		decrypted.Message = message
+		if err := r.HandleMessage(decrypted); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, (<-events).File.ContentURL)
+	}
+	return urls
+}
+
+func uploadFile(t *testing.T, client *gateway.EncryptedClient, content []byte, mimeType string) *gateway.FileMessage {
+	t.Helper()
+	sharedKey, err := gateway.RandomSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := client.UploadFile(bytes.NewReader(content), sharedKey, gateway.FileNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &gateway.FileMessage{FileID: blob.BlobID, SharedKey: sharedKey, MimeType: mimeType, FileSize: blob.Size}
+}
+
+func download(r *relay.Relay, url string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+	return recorder
+}
+
+func TestRelayServesContentAsDownload(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.NewEncryptedClient(account)
+	r := relay.New(client, []byte("secret"))
+	r.ContentBaseURL = "http://relay.example/content/"
+	defer r.Close()
+
+	tests := []struct {
+		mimeType    string
+		contentType string
+	}{
+		{"text/html", "text/html"},
+		{"text/html; charset=utf-8", "text/html; charset=utf-8"},
+		{"invalid type;", "application/octet-stream"},
+		{"", "application/octet-stream"},
+	}
+	for _, test := range tests {
+		content := []byte("<script>alert(1)</script>")
+		url := relayFiles(t, r, uploadFile(t, client, content, test.mimeType))[0]
+		response := download(r, url)
+		if response.Code != http.StatusOK || !bytes.Equal(response.Body.Bytes(), content) {
+			t.Fatalf("%q: unexpected response %d %q", test.mimeType, response.Code, response.Body.Bytes())
+		}
+		header := response.Header()
+		if header.Get("Content-Type") != test.contentType {
+			t.Errorf("%q: served as %q", test.mimeType, header.Get("Content-Type"))
+		}
+		if header.Get("Content-Disposition") != "attachment" || header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%q: content is not served as download: %v", test.mimeType, header)
+		}
+	}
+}
+
+func TestRelayMaxContents(t *testing.T) {
+	server := gatewaytest.NewServer()
+	defer server.Close()
+	account, err := server.NewAccount("*TESTTST", "secret", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.NewEncryptedClient(account)
+	r := relay.New(client, []byte("secret"))
+	r.ContentBaseURL = "http://relay.example/content"
+	r.MaxContents = 2
+	defer r.Close()
+
+	urls := relayFiles(t, r,
+		uploadFile(t, client, []byte("first"), "text/plain"),
+		uploadFile(t, client, []byte("second"), "text/plain"),
+		uploadFile(t, client, []byte("third"), "text/plain"))
+	for i, expected := range []int{http.StatusNotFound, http.StatusOK, http.StatusOK} {
+		if response := download(r, urls[i]); response.Code != expected {
+			t.Errorf("link %d: got status %d, expected %d", i, response.Code, expected)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"container/list"
+	"sync"
+)
+
+// The default number of shared keys cached by the EncryptionHelper
+const DefaultSharedKeyCacheSize = 256
+
+type sharedKeyCacheEntry struct {
+	publicKey PublicKey
+	sharedKey SharedKey
+}
+
+// sharedKeyCache is a least recently used cache of keys shared with peers.
+type sharedKeyCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[PublicKey]*list.Element
+	order   *list.List
+	// Set when the cache was purged, no keys are cached afterwards
+	purged bool
+}
+
+func newSharedKeyCache(size int) *sharedKeyCache {
+	return &sharedKeyCache{
+		size:    size,
+		entries: make(map[PublicKey]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// Copies the cached key into sharedKey and reports if the key was found.
+func (c *sharedKeyCache) get(publicKey *PublicKey, sharedKey *SharedKey) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[*publicKey]
+	if !ok {
+		return false
+	}
+	c.order.MoveToFront(element)
+	*sharedKey = element.Value.(*sharedKeyCacheEntry).sharedKey
+	return true
+}
+
+// Wipe and remove all cached keys and stop caching new keys.
+// The cache is purged when the secret key is destroyed.
+func (c *sharedKeyCache) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purged = true
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		wipe(element.Value.(*sharedKeyCacheEntry).sharedKey[:])
+	}
+	c.entries = make(map[PublicKey]*list.Element, c.size)
+	c.order.Init()
+}
+
+// Cache a copy of the shared key. Keys are not cached after the cache was purged.
+func (c *sharedKeyCache) put(publicKey *PublicKey, sharedKey *SharedKey) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.purged {
+		return
+	}
+	if element, ok := c.entries[*publicKey]; ok {
+		element.Value.(*sharedKeyCacheEntry).sharedKey = *sharedKey
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[*publicKey] = c.order.PushFront(&sharedKeyCacheEntry{
+		publicKey: *publicKey,
+		sharedKey: *sharedKey,
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*sharedKeyCacheEntry)
+		delete(c.entries, entry.publicKey)
+		wipe(entry.sharedKey[:])
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Package status tracks the delivery state of sent messages with the delivery receipts of the recipients.
+*/
+package status
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/callback"
+)
+
+var ErrNotFound = errors.New("message is not tracked")
+
+// How long a receipt for an unknown message is kept by default
+const DefaultPendingReceiptTTL = time.Minute
+
+// The maximum number of kept receipts for unknown messages
+const maxPendingReceipts = 1000
+
+// State is the delivery state of a sent message
+type State int
+
+const (
+	// The message was accepted by the gateway
+	StateSent State = iota
+	// The message was received by the recipient
+	StateReceived
+	// The message was read by the recipient
+	StateRead
+	// The recipient acknowledged (thumbs up) the message
+	StateAcknowledged
+	// The recipient declined (thumbs down) the message
+	StateDeclined
+)
+
+var stateNames = map[State]string{
+	StateSent:         "sent",
+	StateReceived:     "received",
+	StateRead:         "read",
+	StateAcknowledged: "acknowledged",
+	StateDeclined:     "declined",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	name, ok := stateNames[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown state %d", int(s))
+	}
+	return []byte(name), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for state, name := range stateNames {
+		if name == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", text)
+}
+
+// Returns the state of a delivery receipt type
+func stateOfReceipt(deliveryType gateway.DeliveryReceiptType) (State, bool) {
+	switch deliveryType {
+	case gateway.DeliveryReceived:
+		return StateReceived, true
+	case gateway.DeliveryRead:
+		return StateRead, true
+	case gateway.DeliveryAcknowledged:
+		return StateAcknowledged, true
+	case gateway.DeliveryDeclined:
+		return StateDeclined, true
+	}
+	return StateSent, false
+}
+
+// An Event is a change of the delivery state
+type Event struct {
+	State State     `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// The Record contains the delivery state of a sent message
+type Record struct {
+	// The message ID returned by the gateway (hex encoded)
+	MessageID string `json:"messageId"`
+	// The identity the message was sent to
+	RecipientID string `json:"recipientId"`
+	// The current state
+	State State `json:"state"`
+	// All state changes, starting with StateSent
+	History []Event `json:"history"`
+}
+
+// Returns when the message entered the state and whether it did
+func (r *Record) Time(state State) (time.Time, bool) {
+	for _, event := range r.History {
+		if event.State == state {
+			return event.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Apply a state change. Received and read are only applied if the message
+// isn't in a later state yet, while acknowledged and declined can replace each other.
+func (r *Record) update(state State, at time.Time) {
+	r.History = append(r.History, Event{State: state, Time: at})
+	if state > r.State || (r.State >= StateAcknowledged && state >= StateAcknowledged) {
+		r.State = state
+	}
+}
+
+// A Store persists the records of tracked messages
+type Store interface {
+	// Save creates or replaces the record
+	Save(record *Record) error
+	// Load returns the record of the message or ErrNotFound
+	Load(messageID string) (*Record, error)
+}
+
+// A receipt that arrived before the message was recorded as sent
+type pendingReceipt struct {
+	senderID string
+	state    State
+	at       time.Time
+	expires  time.Time
+}
+
+// The Tracker records sent messages and updates their state with received delivery receipts
+type Tracker struct {
+	// How long a receipt for an unknown message is kept, because the receipt can arrive
+	// before Sent is called. If zero, DefaultPendingReceiptTTL is used.
+	PendingReceiptTTL time.Duration
+
+	store   Store
+	mutex   sync.Mutex
+	pending map[string][]pendingReceipt
+}
+
+// Create a tracker that persists the records in the store
+func NewTracker(store Store) *Tracker {
+	return &Tracker{
+		store: store,
+	}
+}
+
+// Record that the message with the ID was sent to the recipient.
+// Receipts of the recipient that arrived before are applied.
+func (t *Tracker) Sent(recipientID string, messageID string, at time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	record := &Record{
+		MessageID:   messageID,
+		RecipientID: recipientID,
+		State:       StateSent,
+		History:     []Event{{State: StateSent, Time: at}},
+	}
+	now := time.Now()
+	for _, receipt := range t.pending[messageID] {
+		if receipt.senderID == recipientID && now.Before(receipt.expires) {
+			record.update(receipt.state, receipt.at)
+		}
+	}
+	if err := t.store.Save(record); err != nil {
+		return err
+	}
+	delete(t.pending, messageID)
+	return nil
+}
+
+// Keep the receipt of an unknown message until it expires
+func (t *Tracker) keepPending(messageID string, receipt pendingReceipt) {
+	ttl := t.PendingReceiptTTL
+	if ttl <= 0 {
+		ttl = DefaultPendingReceiptTTL
+	}
+	now := time.Now()
+	receipt.expires = now.Add(ttl)
+	count := 0
+	for id, receipts := range t.pending {
+		if !now.Before(receipts[len(receipts)-1].expires) {
+			delete(t.pending, id)
+		} else {
+			count += len(receipts)
+		}
+	}
+	if count >= maxPendingReceipts {
+		return
+	}
+	if t.pending == nil {
+		t.pending = make(map[string][]pendingReceipt)
+	}
+	t.pending[messageID] = append(t.pending[messageID], receipt)
+}
+
+// Send the message with the client and track it
+func (t *Tracker) Send(client *gateway.EncryptedClient, recipientID string, message gateway.Message) (messageID string, err error) {
+	messageID, err = client.SendMessage(recipientID, message)
+	if err != nil {
+		return
+	}
+	err = t.Sent(recipientID, messageID, time.Now())
+	return
+}
+
+// Update the state of the tracked messages in the delivery receipt.
+// Receipts from another identity than the recipient are ignored. Receipts for unknown messages
+// are kept for PendingReceiptTTL and applied if the message is recorded by Sent in the meantime.
+func (t *Tracker) Update(senderID string, receipt *gateway.DeliveryReceiptMessage, at time.Time) error {
+	state, ok := stateOfReceipt(receipt.DeliveryType)
+	if !ok {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, messageID := range receipt.MessageIDs {
+		id := hex.EncodeToString(messageID[:])
+		record, err := t.store.Load(id)
+		if err == ErrNotFound {
+			t.keepPending(id, pendingReceipt{senderID: senderID, state: state, at: at})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if record.RecipientID != senderID {
+			continue
+		}
+		record.update(state, at)
+		if err = t.store.Save(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleReceipt can be registered at a callback.Handler for gateway.TypeDeliveryReceipt.
+func (t *Tracker) HandleReceipt(message *callback.DecryptedMessage) error {
+	receipt, ok := message.Message.(*gateway.DeliveryReceiptMessage)
+	if !ok {
+		return nil
+	}
+	return t.Update(message.From, receipt, message.Date)
+}
+
+// Returns the record of the message or ErrNotFound
+func (t *Tracker) Status(messageID string) (*Record, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.store.Load(messageID)
+}
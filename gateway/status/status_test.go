@@ -0,0 +1,111 @@
+package status_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway"
+	"github.com/coffeemakr/threema/gateway/status"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := status.NewTracker(status.NewMemoryStore())
+	start := time.Unix(1600000000, 0)
+	if err := tracker.Sent("ECHOECHO", "0102030405060708", start); err != nil {
+		t.Fatal(err)
+	}
+	messageID := &gateway.MessageID{1, 2, 3, 4, 5, 6, 7, 8}
+	unknownID := &gateway.MessageID{8, 7, 6, 5, 4, 3, 2, 1}
+	receipts := []struct {
+		sender       string
+		deliveryType gateway.DeliveryReceiptType
+	}{
+		{"ECHOECHO", gateway.DeliveryRead},
+		// A late received receipt doesn't reset the state
+		{"ECHOECHO", gateway.DeliveryReceived},
+		// Receipts of other identities are ignored
+		{"OTHERONE", gateway.DeliveryDeclined},
+	}
+	for i, receipt := range receipts {
+		message := &gateway.DeliveryReceiptMessage{
+			DeliveryType: receipt.deliveryType,
+			MessageIDs:   []*gateway.MessageID{messageID, unknownID},
+		}
+		if err := tracker.Update(receipt.sender, message, start.Add(time.Duration(i+1)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record, err := tracker.Status("0102030405060708")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != status.StateRead || len(record.History) != 3 {
+		t.Errorf("unexpected record %#v", record)
+	}
+	if read, ok := record.Time(status.StateRead); !ok || !read.Equal(start.Add(time.Minute)) {
+		t.Errorf("read at %s", read)
+	}
+	if _, err = tracker.Status("0807060504030201"); err != status.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTrackerEarlyReceipt(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	receipt := func(deliveryType gateway.DeliveryReceiptType) *gateway.DeliveryReceiptMessage {
+		return &gateway.DeliveryReceiptMessage{
+			DeliveryType: deliveryType,
+			MessageIDs:   []*gateway.MessageID{{1, 2, 3, 4, 5, 6, 7, 8}},
+		}
+	}
+
+	tracker := status.NewTracker(status.NewMemoryStore())
+	// The receipt arrives before the gateway responded to the send request
+	if err := tracker.Update("ECHOECHO", receipt(gateway.DeliveryReceived), start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Update("OTHERONE", receipt(gateway.DeliveryDeclined), start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Sent("ECHOECHO", "0102030405060708", start); err != nil {
+		t.Fatal(err)
+	}
+	record, err := tracker.Status("0102030405060708")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != status.StateReceived || len(record.History) != 2 {
+		t.Errorf("unexpected record %#v", record)
+	}
+
+	tracker = status.NewTracker(status.NewMemoryStore())
+	tracker.PendingReceiptTTL = time.Nanosecond
+	if err = tracker.Update("ECHOECHO", receipt(gateway.DeliveryRead), start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err = tracker.Sent("ECHOECHO", "0102030405060708", start); err != nil {
+		t.Fatal(err)
+	}
+	if record, err = tracker.Status("0102030405060708"); err != nil || record.State != status.StateSent {
+		t.Errorf("expired receipt was applied: %#v, %v", record, err)
+	}
+}
+
+func TestStateText(t *testing.T) {
+	for _, state := range []status.State{status.StateSent, status.StateReceived, status.StateRead, status.StateAcknowledged, status.StateDeclined} {
+		text, err := state.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded status.State
+		if err = decoded.UnmarshalText(text); err != nil || decoded != state {
+			t.Errorf("%s decoded as %s, %v", text, decoded, err)
+		}
+	}
+	var state status.State
+	if err := state.UnmarshalText([]byte("lost")); err == nil {
+		t.Error("unknown state was accepted")
+	}
+}
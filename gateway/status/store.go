@@ -0,0 +1,132 @@
+package status
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type memoryStore struct {
+	mutex   sync.Mutex
+	records map[string]Record
+}
+
+// Create a Store that keeps the records in memory
+func NewMemoryStore() Store {
+	return &memoryStore{
+		records: make(map[string]Record),
+	}
+}
+
+func (s *memoryStore) Save(record *Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records[record.MessageID] = copyRecord(record)
+	return nil
+}
+
+func (s *memoryStore) Load(messageID string) (*Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.records[messageID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := copyRecord(&record)
+	return &result, nil
+}
+
+func copyRecord(record *Record) Record {
+	result := *record
+	result.History = append([]Event(nil), record.History...)
+	return result
+}
+
+// The FileStore keeps the records in memory and writes all of them to a JSON file on every change.
+// Every change costs time proportional to the number of records, so it suits a few thousand
+// tracked messages. Implement Store with a database for more.
+type FileStore struct {
+	path   string
+	memory *memoryStore
+}
+
+// Open the store in the file. The records are loaded if the file exists.
+func OpenFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		path: path,
+		memory: &memoryStore{
+			records: make(map[string]Record),
+		},
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &store.memory.records); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Save the record and write all records to the file.
+// If the file can't be written, the record is not saved in memory either.
+func (s *FileStore) Save(record *Record) error {
+	s.memory.mutex.Lock()
+	defer s.memory.mutex.Unlock()
+	previous, existed := s.memory.records[record.MessageID]
+	s.memory.records[record.MessageID] = copyRecord(record)
+	err := s.write()
+	if err != nil {
+		if existed {
+			s.memory.records[record.MessageID] = previous
+		} else {
+			delete(s.memory.records, record.MessageID)
+		}
+	}
+	return err
+}
+
+// Write the records to a temporary file and replace the file with it, so the store isn't corrupted by a crash
+func (s *FileStore) write() error {
+	content, err := json.Marshal(s.memory.records)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tempFile.Write(content); err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	// Sync the directory, so the renamed file is persisted
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = dirFile.Sync()
+	if closeErr := dirFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *FileStore) Load(messageID string) (*Record, error) {
+	return s.memory.Load(messageID)
+}
@@ -0,0 +1,55 @@
+package status_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coffeemakr/threema/gateway/status"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.json")
+	store, err := status.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &status.Record{
+		MessageID:   "0102030405060708",
+		RecipientID: "ECHOECHO",
+		History:     []status.Event{{State: status.StateSent, Time: time.Unix(1600000000, 0)}},
+	}
+	if err = store.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := status.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := reopened.Load(record.MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RecipientID != "ECHOECHO" || len(loaded.History) != 1 {
+		t.Errorf("unexpected record %#v", loaded)
+	}
+
+	// A record that can't be written is not kept in memory
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Save(&status.Record{MessageID: "1112131415161718", RecipientID: "ECHOECHO"}); err == nil {
+		t.Fatal("saved without directory")
+	}
+	if _, err = store.Load("1112131415161718"); err != status.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
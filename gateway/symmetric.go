@@ -4,14 +4,20 @@ import (
 	"crypto/rand"
 	"errors"
 	"golang.org/x/crypto/nacl/secretbox"
+	"io"
 )
 
 const cryptoBoxSharedKeyBytes = 32
 type SharedKey = [cryptoBoxSharedKeyBytes]byte
 
 func RandomSecretKey()  (*SharedKey, error) {
+	return RandomSecretKeyFrom(rand.Reader)
+}
+
+// Create a shared key with the bytes read from random
+func RandomSecretKeyFrom(random io.Reader) (*SharedKey, error) {
 	key := new(SharedKey)
-	_, err := rand.Read(key[:])
+	_, err := io.ReadFull(random, key[:])
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Known answer of TestSecretBox in golang.org/x/crypto/nacl/secretbox, which was generated with the
+// C implementation of NaCl (crypto_secretbox with key 0x01..., nonce 0x02... and a message of 64 times 0x03)
+const naclSecretBoxVector = "8442bc313f4626f1359e3b50122b6ce6fe66ddfe7d39d14e637eb4fd5b45beadab55198df6ab5368439792a23c87db70acb6156dc5ef957ac04f6276cf6093b84be77ff0849cc33e34b7254d5a8f65ad"
+
+func TestEncryptWithSharedKey(t *testing.T) {
+	box := EncryptWithSharedKey(filled(3, 64), filledNonce(2), filledKey(1))
+	if hex.EncodeToString(box) != naclSecretBoxVector {
+		t.Errorf("got %x, expected %s", box, naclSecretBoxVector)
+	}
+}
+
+func TestDecryptWithSharedSecret(t *testing.T) {
+	plaintext, err := DecryptWithSharedSecret(mustDecodeHex(t, naclSecretBoxVector), filledNonce(2), filledKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, filled(3, 64)) {
+		t.Errorf("got %x", plaintext)
+	}
+	if _, err = DecryptWithSharedSecret(mustDecodeHex(t, naclSecretBoxVector), filledNonce(2), filledKey(2)); err == nil {
+		t.Error("decryption with wrong key succeeded")
+	}
+}
+
+func TestFileAndThumbnailNonce(t *testing.T) {
+	tests := []struct {
+		name     string
+		nonce    *Nonce
+		expected string
+	}{
+		{"file", FileNonce, "000000000000000000000000000000000000000000000001"},
+		{"thumbnail", ThumbnailNonce, "000000000000000000000000000000000000000000000002"},
+	}
+	key := filledKey(1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if hex.EncodeToString(test.nonce[:]) != test.expected {
+				t.Errorf("got %x, expected %s", test.nonce[:], test.expected)
+			}
+			box := EncryptWithSharedKey([]byte("blob content"), test.nonce, key)
+			plaintext, err := DecryptWithSharedSecret(box, test.nonce, key)
+			if err != nil || string(plaintext) != "blob content" {
+				t.Errorf("round trip failed: %q, %v", plaintext, err)
+			}
+		})
+	}
+	// The file and the thumbnail share the key, so the nonces must differ
+	fileBox := EncryptWithSharedKey([]byte("blob content"), FileNonce, key)
+	if _, err := DecryptWithSharedSecret(fileBox, ThumbnailNonce, key); err == nil {
+		t.Error("file box could be decrypted with thumbnail nonce")
+	}
+}